@@ -5,13 +5,13 @@ go 1.26
 toolchain go1.26.6
 
 require (
+	cloud.google.com/go/compute/metadata v0.6.0
 	github.com/google/uuid v1.6.0
 	github.com/jessevdk/go-flags v1.6.1
 	golang.org/x/oauth2 v0.28.0
+	golang.org/x/sys v0.31.0
 )
 
 require (
-	cloud.google.com/go/compute/metadata v0.6.0 // indirect
 	github.com/google/go-cmp v0.7.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
 )
@@ -14,12 +14,17 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -28,10 +33,13 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/oauth2l/util"
+	"golang.org/x/oauth2"
 )
 
 // Use this flag to update golden files with test outputs from current run.
@@ -344,7 +352,7 @@ func Test3LOFlow(t *testing.T) {
 		{
 			"fetch; 3lo cached; token expired",
 			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-client-secrets-expired-token.json"},
-			"fetch-3lo.golden",
+			"fetch-3lo-cached.golden",
 			false,
 		},
 		{
@@ -443,7 +451,7 @@ func Test3LOLoopbackFlow(t *testing.T) {
 			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-client-secrets-expired-token-3lo-loopback.json",
 				"--disableAutoOpenConsentPage",
 				"--consentPageInteractionTimeout", CONSENT_PAGE_TIMEOUT, "--consentPageInteractionTimeoutUnits", CONSENT_PAGE_TIMEOUT_UNITS},
-			"fetch-3lo-loopback.golden",
+			"fetch-3lo-cached.golden",
 			false,
 		},
 		{
@@ -598,169 +606,2083 @@ func Test2LOFlow(t *testing.T) {
 	runTestScenarios(t, tests)
 }
 
-// Test JWT Flow.
-func TestJWTFlow(t *testing.T) {
+// Test encryption of the token cache. The cache initially holds a plaintext entry,
+// which is expected to be migrated to the encrypted format.
+func TestEncryptedCache(t *testing.T) {
+	// Seed the cache with a plaintext token, which must remain readable
+	// once the cache is encrypted.
+	cache := writeTokenCache(t, "integration/fixtures/fake-service-account.json", "https://www.googleapis.com/auth/pubsub",
+		`{"access_token":"ya29.plaintext-cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z"}`, time.Now())
+	if err := os.Chmod(cache, 0666); err != nil {
+		t.Fatalf("could not chmod %s: %v", cache, err)
+	}
+
 	tests := []testCase{
 		{
-			"fetch; jwt",
-			[]string{"fetch", "--type", "jwt", "--audience", "https://pubsub.googleapis.com/", "--credentials", "integration/fixtures/fake-service-account.json"},
-			"fetch-jwt.golden",
+			"fetch; 2lo; encrypted cache; plaintext token",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache,
+				"--cache-key-file", "integration/fixtures/fake-cache-key"},
+			"fetch-plaintext-cache.golden",
 			false,
 		},
 		{
-			"fetch; jwt; old interface",
-			[]string{"fetch", "--jwt", "--json", "integration/fixtures/fake-service-account.json", "https://pubsub.googleapis.com/"},
-			"fetch-jwt.golden",
+			"fetch; 2lo; encrypted cache",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache,
+				"--cache-key-file", "integration/fixtures/fake-cache-key"},
+			"fetch-2lo.golden",
+			false,
+		},
+		{
+			"fetch; 2lo; encrypted cache; migrated plaintext token",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache,
+				"--cache-key-file", "integration/fixtures/fake-cache-key"},
+			"fetch-plaintext-cache.golden",
 			false,
 		},
+		{
+			"fetch; 2lo; encrypted cache; wrong key",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache,
+				"--cache-key-file", "integration/fixtures/fake-cache-key-wrong"},
+			"cache-wrong-key.golden",
+			true,
+		},
+		{
+			"cache list; encrypted cache; wrong key",
+			[]string{"cache", "list", "--cache", cache, "--cache-key-file", "integration/fixtures/fake-cache-key-wrong"},
+			"cache-wrong-key.golden",
+			true,
+		},
+		{
+			"fetch; 2lo; encrypted cache; short key",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache,
+				"--cache-key-file", "integration/fixtures/fake-cache-key-short"},
+			"cache-short-key.golden",
+			true,
+		},
+		{
+			"fetch; 2lo; encrypted cache; no key",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache},
+			"cache-no-key.golden",
+			true,
+		},
 	}
+	runTestScenarios(t, tests)
 
-	processJwtOutput := func(jwt string) string {
-		//JWT is signed with a timestamp that differs in every execution, so we will strip out "exp" and "iat" fields
-		encodedPayload := strings.Split(jwt, ".")[1]
-		decodedPayload, _ := base64.RawStdEncoding.DecodeString(encodedPayload)
-		var jsonData map[string]interface{}
-		json.Unmarshal(decodedPayload, &jsonData) // nolint:errcheck
-		delete(jsonData, "exp")
-		delete(jsonData, "iat")
-		jsonString, _ := json.Marshal(jsonData)
-		return string(jsonString)
+	info, err := os.Stat(cache)
+	if err != nil {
+		t.Fatalf("could not stat %s: %v", cache, err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected cache permissions 0600, got %v", info.Mode().Perm())
+	}
+	if content := readFile(cache); strings.HasPrefix(content, "{") {
+		t.Fatalf("Expected encrypted cache, got %s", content)
 	}
-	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processJwtOutput)
 }
 
-// Test SSO Flow. Uses "sh" to invoke fake ssocli to return a mock access token.
-func TestSSOFlow(t *testing.T) {
+// Test migration of cache files written by previous versions, which used
+// the JSON encoded CacheKey, including the credentials, as key. Migrated
+// tokens are only reused for the scopes of other OAuth tokens.
+func TestLegacyCacheMigration(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	legacyKey, _ := json.Marshal(util.CacheKey{
+		CredentialsJSON: readFile("integration/fixtures/fake-service-account.json"),
+		Scope:           "https://www.googleapis.com/auth/pubsub",
+	})
+	legacySupersetKey, _ := json.Marshal(util.CacheKey{
+		CredentialsJSON: readFile("integration/fixtures/fake-service-account.json"),
+		Scope:           "https://www.googleapis.com/auth/pubsub https://www.googleapis.com/auth/cloud-platform",
+	})
+	legacyToken := `{"access_token":"ya29.legacy-cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z"}`
+	legacyCache, _ := json.Marshal(map[string][]byte{string(legacyKey): []byte(legacyToken),
+		string(legacySupersetKey): []byte(legacyToken)})
+	if err := ioutil.WriteFile(cache, legacyCache, 0666); err != nil {
+		t.Fatalf("could not write %s: %v", cache, err)
+	}
+
 	tests := []testCase{
 		{
-			"fetch; sso",
-			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh"},
-			"fetch-sso.golden",
+			"fetch; 2lo; legacy cache",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache},
+			"fetch-legacy-cache.golden",
 			false,
 		},
 		{
-			"fetch; sso; old interface",
-			[]string{"fetch", "--sso", "--ssocli", "sh", "integration/fixtures/fake-ssocli.sh", "pubsub"},
-			"fetch-sso.golden",
+			"fetch; 2lo; legacy cache; subset of scopes",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", cache},
+			"fetch-legacy-cache.golden",
 			false,
 		},
 	}
 	runTestScenarios(t, tests)
+
+	// A JWT is signed instead of reusing the legacy access token.
+	jwtTests := []testCase{
+		{
+			"fetch; jwt; legacy cache; subset of scopes",
+			[]string{"fetch", "--type", "jwt", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-service-account.json",
+				"--cache", cache},
+			"fetch-jwt-legacy-cache.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, jwtTests, nil, func(jwt string) string {
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			return jwt
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		return string(header)
+	})
+
+	if content := readFile(cache); strings.Contains(content, "private_key") {
+		t.Fatalf("Expected credentials to be removed from cache, got %s", content)
+	}
 }
 
-// Test STS Flow.
-func TestStsFlow(t *testing.T) {
+// Test cache subcommands against a cache holding a valid and an expired token.
+func TestCacheCommand(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	credentials := readFile("integration/fixtures/fake-service-account.json")
+	validKey, _ := json.Marshal(util.CacheKey{
+		CredentialsJSON: credentials,
+		Scope:           "https://www.googleapis.com/auth/pubsub",
+	})
+	expiredKey, _ := json.Marshal(util.CacheKey{
+		CredentialsJSON: credentials,
+		Scope:           "https://www.googleapis.com/auth/cloud-platform https://www.googleapis.com/auth/userinfo.email",
+	})
+	validToken := `{"access_token":"ya29.valid-cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z"}`
+	expiredToken := `{"access_token":"ya29.expired-cached-token","token_type":"Bearer","expiry":"2001-01-01T00:00:00Z"}`
+	seedCache, _ := json.Marshal(map[string][]byte{
+		string(validKey):   []byte(validToken),
+		string(expiredKey): []byte(expiredToken),
+	})
+	if err := ioutil.WriteFile(cache, seedCache, 0666); err != nil {
+		t.Fatalf("could not write %s: %v", cache, err)
+	}
+
 	tests := []testCase{
 		{
-			"fetch; 2lo; sts",
-			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--sts", "--audience", "http://test.com", "--quota_project", "TestQuotaProject", "--output_format", "json"},
-			"fetch-sts.golden",
+			"cache list",
+			[]string{"cache", "list", "--cache", cache},
+			"cache-list.golden",
 			false,
 		},
 		{
-			"fetch; sso; sts",
-			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh", "--sts", "--audience", "http://test.com", "--quota_project", "TestQuotaProject", "--output_format", "json"},
-			"fetch-sts.golden",
+			"cache list; scope filter",
+			[]string{"cache", "list", "--scope", "pubsub", "--cache", cache},
+			"cache-list-scope.golden",
+			false,
+		},
+		{
+			"cache list; expired filter",
+			[]string{"cache", "list", "--expired", "--cache", cache},
+			"cache-list-expired.golden",
+			false,
+		},
+		{
+			"cache show",
+			[]string{"cache", "show", "f1b60abd", "--cache", cache},
+			"cache-show.golden",
+			false,
+		},
+		{
+			"cache show; unknown id",
+			[]string{"cache", "show", "0000", "--cache", cache},
+			"cache-show-unknown.golden",
+			true,
+		},
+		{
+			"cache delete; no filter",
+			[]string{"cache", "delete", "--cache", cache},
+			"cache-delete-no-filter.golden",
+			true,
+		},
+		{
+			"cache delete; expired filter",
+			[]string{"cache", "delete", "--expired", "--cache", cache},
+			"cache-delete.golden",
+			false,
+		},
+		{
+			"cache list; after delete",
+			[]string{"cache", "list", "--cache", cache},
+			"cache-list-scope.golden",
 			false,
 		},
 	}
+	runTestScenarios(t, tests)
+}
 
-	processStsOutput := func(sts string) string {
-		//STS token differs in every execution even for the same subject token, so we will strip out "access_token" field.
-		var jsonData map[string]interface{}
-		json.Unmarshal([]byte(sts), &jsonData) // nolint:errcheck
-		delete(jsonData, "access_token")
-		jsonString, _ := json.Marshal(jsonData)
-		return string(jsonString)
+// Writes a cache file holding the given token for the given credentials and scope.
+func writeTokenCache(t *testing.T, credentials string, scope string, token string, cachedAt time.Time) string {
+	key := util.CacheKey{
+		CredentialsJSON: readFile(credentials),
+		Scope:           scope,
 	}
-	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processStsOutput)
+	return writeTokenCacheWithKey(t, key, token, cachedAt)
 }
 
-// Test Service Account Impersonation Flow.
-// This currently sends request to the real IAM endpoint, which will return 401 for having invalid user access token, which is expected.
-func TestServiceAccountImpersonationFlow(t *testing.T) {
+// writeTokenCacheWithKey writes a cache file holding the token for the given key.
+func writeTokenCacheWithKey(t *testing.T, key util.CacheKey, token string, cachedAt time.Time) string {
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	info := key.Info()
+	info.AuthType = util.AuthTypeOAuth
+	val, _ := json.Marshal(map[string]interface{}{
+		"key":       info,
+		"token":     json.RawMessage(token),
+		"cached_at": cachedAt,
+	})
+	data, _ := json.Marshal(map[string][]byte{key.Digest(): val})
+	if err := ioutil.WriteFile(cache, data, 0600); err != nil {
+		t.Fatalf("could not write %s: %v", cache, err)
+	}
+	return cache
+}
+
+// Test that cached tokens about to expire, and tokens without expiry
+// cached for longer than the TTL, are fetched again.
+func TestCachedTokenValidity(t *testing.T) {
+	serviceAccount := "integration/fixtures/fake-service-account.json"
+	now := time.Now()
+	expiring := fmt.Sprintf(`{"access_token":"ya29.cached-token","token_type":"Bearer","expiry":"%s"}`,
+		now.Add(30*time.Second).Format(time.RFC3339))
+	noExpiry := `{"access_token":"ya29.cached-token","token_type":"Bearer"}`
+	pubsub := "https://www.googleapis.com/auth/pubsub"
+	args := []string{"header", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache"}
 
 	tests := []testCase{
 		{
-			"fetch; sso; impersonation",
-			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh", "--impersonate-service-account", "12345"},
-			"fetch-impersonation.golden",
+			"header; 2lo; expiring token",
+			append(args, writeTokenCache(t, serviceAccount, pubsub, expiring, now)),
+			"header-2lo.golden",
+			false,
+		},
+		{
+			"header; 2lo; expiring token; no min validity",
+			append(args, writeTokenCache(t, serviceAccount, pubsub, expiring, now), "--min-validity", "0s"),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; no expiry",
+			append(args, writeTokenCache(t, serviceAccount, pubsub, noExpiry, now)),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; no expiry; ttl elapsed",
+			append(args, writeTokenCache(t, serviceAccount, pubsub, noExpiry, now.Add(-2*time.Hour))),
+			"header-2lo.golden",
+			false,
+		},
+		{
+			"header; 2lo; no expiry; no ttl",
+			append(args, writeTokenCache(t, serviceAccount, pubsub, noExpiry, now.Add(-2*time.Hour)), "--cache-ttl", "0s"),
+			"header-cached.golden",
 			false,
 		},
 	}
+	runTestScenarios(t, tests)
+}
 
-	processOutput := func(output string) string {
-		//Error details are constantly changing, so we will strip out "error.details" field.
-		var jsonData map[string]interface{}
-		json.Unmarshal([]byte(output), &jsonData) // nolint:errcheck
-		delete(jsonData["error"].(map[string]interface{}), "details")
-		jsonString, _ := json.Marshal(jsonData)
-		return string(jsonString)
+// Test that cached tokens are reused regardless of the order of the scopes,
+// and for subsets of the scopes they were granted for.
+func TestCachedTokenScopes(t *testing.T) {
+	serviceAccount := "integration/fixtures/fake-service-account.json"
+	valid := `{"access_token":"ya29.cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z"}`
+	validWithScope := `{"access_token":"ya29.cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z",` +
+		`"scope":"https://www.googleapis.com/auth/cloud-platform https://www.googleapis.com/auth/pubsub"}`
+	cloudPlatform := "https://www.googleapis.com/auth/cloud-platform"
+	cloudPlatformPubsub := "https://www.googleapis.com/auth/pubsub https://www.googleapis.com/auth/cloud-platform"
+	args := []string{"header", "--credentials", "integration/fixtures/fake-service-account.json", "--cache"}
+
+	tests := []testCase{
+		{
+			"header; 2lo; scopes in different order",
+			append(args, writeTokenCache(t, serviceAccount, cloudPlatformPubsub, valid, time.Now()), "--scope", "cloud-platform,pubsub"),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; subset of requested scopes",
+			append(args, writeTokenCache(t, serviceAccount, cloudPlatformPubsub, valid, time.Now()), "--scope", "pubsub"),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; subset of granted scopes",
+			append(args, writeTokenCache(t, serviceAccount, cloudPlatform, validWithScope, time.Now()), "--scope", "pubsub"),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; scopes not granted",
+			append(args, writeTokenCache(t, serviceAccount, cloudPlatform, valid, time.Now()), "--scope", "pubsub"),
+			"header-2lo.golden",
+			false,
+		},
 	}
+	runTestScenarios(t, tests)
+}
+
+// Test that the delegation chain and lifetime of impersonated tokens are
+// part of the cache key.
+func TestCachedImpersonatedToken(t *testing.T) {
+	key := util.CacheKey{
+		CredentialsJSON: readFile("integration/fixtures/fake-service-account.json"),
+		Scope:           "https://www.googleapis.com/auth/pubsub",
+		ServiceAccount:  "target@example.iam.gserviceaccount.com",
+		Delegates:       []string{"first@example.iam.gserviceaccount.com", "second@example.iam.gserviceaccount.com"},
+		Lifetime:        30 * time.Minute,
+	}
+	valid := `{"access_token":"ya29.cached-token","token_type":"Bearer","expiry":"2999-01-01T00:00:00Z"}`
+	args := []string{"header", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json",
+		"--impersonate-service-account", "target@example.iam.gserviceaccount.com"}
 
-	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processOutput)
+	tests := []testCase{
+		{
+			"header; 2lo; impersonation with delegates and lifetime",
+			append(args, "--delegates", "first@example.iam.gserviceaccount.com,second@example.iam.gserviceaccount.com",
+				"--impersonate-lifetime", "30m", "--cache", writeTokenCacheWithKey(t, key, valid, time.Now())),
+			"header-cached.golden",
+			false,
+		},
+		{
+			"header; 2lo; delegates without impersonation",
+			[]string{"header", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json",
+				"--delegates", "first@example.iam.gserviceaccount.com"},
+			"delegates-no-impersonation.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
 }
 
-// getCredentialsFileName finds the credentials filename provided in the testCase arguments.
-// If no filename is found, an empty string is returned.
-//
-// Note: the "--credentials" or "--json" options are used to find the credentials file.
-//
-// input tc: is the test case.
-func getCredentialsFileName(tc *testCase) string {
-	var a string
-	var i int
-	for i, a = range tc.args {
-		if a == "--credentials" || a == "--json" {
-			break
+// Test that a token for a subset of the scopes of an expired cached token is
+// obtained from its refresh token, without authorizing again. Failures other
+// than a revoked refresh token are reported instead of authorizing again.
+func TestCachedRefreshTokenScopes(t *testing.T) {
+	clientId := "integration/fixtures/fake-client-secrets.json"
+	unavailableClientId := "integration/fixtures/fake-client-secrets-unavailable-token.json"
+	expired := `{"access_token":"ya29.expired-token","token_type":"Bearer","expiry":"2001-01-01T00:00:00Z",` +
+		`"refresh_token":"1/cached-refresh-token"}`
+	cloudPlatformEmail := "https://www.googleapis.com/auth/cloud-platform https://www.googleapis.com/auth/userinfo.email"
+
+	tests := []testCase{
+		{
+			"fetch; 3lo; subset of cached scopes; token endpoint unavailable",
+			[]string{"fetch", "--scope", "userinfo.email", "--credentials", unavailableClientId, "--cache",
+				writeTokenCache(t, unavailableClientId, cloudPlatformEmail, expired, time.Now())},
+			"fetch-3lo-token-endpoint-unavailable.golden",
+			true,
+		},
+		{
+			"fetch; 3lo; subset of cached scopes",
+			[]string{"fetch", "--scope", "userinfo.email", "--credentials", clientId, "--cache",
+				writeTokenCache(t, clientId, cloudPlatformEmail, expired, time.Now())},
+			"fetch-3lo-cached.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	form, _ := lastTokenRequest.Load().(url.Values)
+	expected := map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": "1/cached-refresh-token",
+		"scope":         "https://www.googleapis.com/auth/userinfo.email",
+	}
+	for k, v := range expected {
+		if actual := form.Get(k); actual != v {
+			t.Fatalf("Expected token request parameter %s=%s, got %s", k, v, actual)
 		}
 	}
-	if i >= len(tc.args)-1 {
-		return ""
+}
+
+// Test that a cached token whose refresh token has been revoked is evicted,
+// and a new token is obtained with the 3LO flow unless prompting is disabled.
+func TestRevokedRefreshToken(t *testing.T) {
+	clientId := "integration/fixtures/fake-client-secrets-revoked-refresh-token.json"
+	expired := `{"access_token":"ya29.expired-token","token_type":"Bearer","expiry":"2001-01-01T00:00:00Z",` +
+		`"refresh_token":"1/revoked-refresh-token"}`
+	pubsub := "https://www.googleapis.com/auth/pubsub"
+	noPromptCache := writeTokenCache(t, clientId, pubsub, expired, time.Now())
+
+	tests := []testCase{
+		{
+			"fetch; 3lo; revoked refresh token",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", clientId, "--cache",
+				writeTokenCache(t, clientId, pubsub, expired, time.Now())},
+			"fetch-3lo.golden",
+			false,
+		},
+		{
+			"fetch; 3lo; revoked refresh token; no prompt",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", clientId, "--cache", noPromptCache, "--no-prompt"},
+			"fetch-no-prompt.golden",
+			true,
+		},
+		{
+			"cache list; revoked refresh token evicted",
+			[]string{"cache", "list", "--cache", noPromptCache},
+			"cache-list-empty.golden",
+			false,
+		},
 	}
-	return path.Base(tc.args[i+1])
+	process3LOOutput := func(output string) string {
+		return removeCodeChallenge(output)
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, tests, newFixture(t, "fake-verification-code.fixture").asFile(), process3LOOutput)
 }
 
-// changeCredentialsFileName replaces the credentials filename in the test arguments.
-// If the credentials file is not found, no changes are made.
-//
-// input tc: is the test case.
-// input filename: is the new filename.
-func changeCredentialsFileName(tc *testCase, filename string) {
-	var a string
-	var i int
-	for i, a = range tc.args {
-		if a == "--credentials" || a == "--json" {
-			break
+// Test concurrent processes sharing the same cache. Only one of them is expected
+// to fetch the token, while the others wait and reuse the cached token.
+func TestConcurrentCacheAccess(t *testing.T) {
+	const processes = 10
+	dir := t.TempDir()
+	stores := []string{filepath.Join(dir, "oauth2l-cache"), "dir:" + filepath.Join(dir, "oauth2l-cache-dir")}
+	expected := newGoldenFile(t, "header-2lo.golden").load()
+
+	for _, cache := range stores {
+		args := []string{"header", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account-slow-token.json", "--cache", cache}
+		atomic.StoreInt32(&slowTokenRequests, 0)
+		outputs := make(chan string, processes)
+		for i := 0; i < processes; i++ {
+			go func() {
+				output, err := exec.Command(binaryPath, args...).CombinedOutput()
+				if err != nil {
+					output = []byte(err.Error())
+				}
+				outputs <- string(output)
+			}()
+		}
+		for i := 0; i < processes; i++ {
+			if actual := <-outputs; actual != expected {
+				t.Errorf("Expected: %v Actual: %v", expected, actual)
+			}
+		}
+		if requests := atomic.LoadInt32(&slowTokenRequests); requests != 1 {
+			t.Fatalf("Expected 1 token request with cache %s, got %d", cache, requests)
 		}
 	}
-	if i >= len(tc.args)-1 {
-		return
-	}
-	dir := path.Dir(tc.args[i+1])
-	tc.args[i+1] = dir + "/" + filename
 }
 
-func readFile(path string) string {
-	content, err := ioutil.ReadFile(path)
+// Test cache store selectors.
+func TestCacheStores(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "oauth2l-cache-dir")
+	tests := []testCase{
+		{
+			"fetch; 2lo; dir cache",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", "dir:" + dir},
+			"fetch-2lo.golden",
+			false,
+		},
+		{
+			"fetch; 2lo; dir cache; cached token",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", "dir:" + dir,
+				"--cache-key-file", "integration/fixtures/fake-cache-key"},
+			"fetch-2lo.golden",
+			false,
+		},
+		{
+			"fetch; 2lo; memory cache",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", "memory:"},
+			"fetch-2lo.golden",
+			false,
+		},
+		{
+			"fetch; 2lo; invalid cache selector",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--cache", "memory:foo"},
+			"cache-invalid-selector.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		fmt.Printf("could not read file %s: %v", path, err)
+		t.Fatalf("could not read %s: %v", dir, err)
+	}
+	entries := 0
+	for _, file := range files {
+		if file.Name() == ".lock" {
+			continue
+		}
+		entries++
+		if runtime.GOOS != "windows" && file.Mode().Perm() != 0600 {
+			t.Fatalf("Expected cache entry permissions 0600, got %v", file.Mode().Perm())
+		}
+		if content := readFile(filepath.Join(dir, file.Name())); strings.HasPrefix(content, "{") {
+			t.Fatalf("Expected encrypted cache entry, got %s", content)
+		}
+	}
+	if entries != 1 {
+		t.Fatalf("Expected 1 cache entry, got %d", entries)
+	}
+
+	// The default store uses the deprecated CacheLocation, if changed.
+	defer func(location string) { util.CacheLocation = location }(util.CacheLocation)
+	util.CacheLocation = filepath.Join(t.TempDir(), "oauth2l-location")
+	settings := &util.Settings{CredentialsJSON: readFile("integration/fixtures/fake-service-account.json"),
+		Scope: "https://www.googleapis.com/auth/pubsub"}
+	util.InsertCache(settings, &oauth2.Token{AccessToken: "ya29.location-token", Expiry: time.Now().Add(time.Hour)})
+	if _, err := os.Stat(util.CacheLocation); err != nil {
+		t.Fatalf("Expected cache file at CacheLocation: %v", err)
+	}
+	util.CacheLocation = ""
+	if token, err := util.LookupCache(settings); err != nil || token != nil {
+		t.Fatalf("Expected caching to be disabled by an empty CacheLocation, got %v: %v", token, err)
 	}
-	return string(content)
 }
 
+// Test JWT Flow.
+func TestJWTFlow(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; jwt",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://pubsub.googleapis.com/", "--credentials", "integration/fixtures/fake-service-account.json"},
+			"fetch-jwt.golden",
+			false,
+		},
+		{
+			"fetch; jwt; old interface",
+			[]string{"fetch", "--jwt", "--json", "integration/fixtures/fake-service-account.json", "https://pubsub.googleapis.com/"},
+			"fetch-jwt.golden",
+			false,
+		},
+	}
+
+	processJwtOutput := func(jwt string) string {
+		//JWT is signed with a timestamp that differs in every execution, so we will strip out "exp" and "iat" fields
+		encodedPayload := strings.Split(jwt, ".")[1]
+		decodedPayload, _ := base64.RawStdEncoding.DecodeString(encodedPayload)
+		var jsonData map[string]interface{}
+		json.Unmarshal(decodedPayload, &jsonData) // nolint:errcheck
+		delete(jsonData, "exp")
+		delete(jsonData, "iat")
+		jsonString, _ := json.Marshal(jsonData)
+		return string(jsonString)
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processJwtOutput)
+}
+
+// Test self-signed JWTs with custom claims, which are signed with the
+// Service Account key.
+func TestJWTCustomClaims(t *testing.T) {
+	serviceAccount := "integration/fixtures/fake-service-account.json"
+	tests := []testCase{
+		{
+			"fetch; jwt; custom claims",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials", serviceAccount,
+				"--issuer", "https://issuer.example.com", "--subject", "user@example.com", "--lifetime", "5m",
+				"--claim", "email=user@example.com", "--claim", "admin=true", "--claim", "level=3", "--cache", ""},
+			"fetch-jwt-custom-claims.golden",
+			false,
+		},
+		{
+			"fetch; jwt; claims file",
+			[]string{"fetch", "--type", "jwt", "--credentials", serviceAccount, "--claims-file", "integration/fixtures/fake-claims.json",
+				"--claim", "tenant=other", "--cache", ""},
+			"fetch-jwt-claims-file.golden",
+			false,
+		},
+		{
+			"header; jwt; custom claims",
+			[]string{"header", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials", serviceAccount,
+				"--subject", "user@example.com", "--cache", ""},
+			"header-jwt-custom-claims.golden",
+			false,
+		},
+		{
+			"fetch; jwt; invalid exp claim",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials", serviceAccount,
+				"--claim", "exp=tomorrow", "--cache", ""},
+			"fetch-jwt-invalid-exp-claim.golden",
+			true,
+		},
+	}
+
+	// JWT is signed with a timestamp that differs in every execution, so the
+	// "exp" and "iat" claims are replaced by the lifetime.
+	processJwtOutput := func(output string) string {
+		prefix := ""
+		if strings.HasPrefix(output, "Authorization: Bearer ") {
+			prefix = "Authorization: Bearer "
+		}
+		parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(output), prefix), ".")
+		if len(parts) != 3 {
+			return output
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(payload, &claims) // nolint:errcheck
+		exp, _ := claims["exp"].(float64)
+		iat, _ := claims["iat"].(float64)
+		delete(claims, "exp")
+		delete(claims, "iat")
+		claims["lifetime"] = exp - iat
+		jsonString, _ := json.Marshal(claims)
+		return prefix + string(header) + "\n" + string(jsonString)
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processJwtOutput)
+
+	// The token expires at the custom "exp" claim rather than after the lifetime.
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	expTests := []testCase{
+		{
+			"fetch; jwt; custom exp claim",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials", serviceAccount,
+				"--claim", "exp=4102444800", "--cache", cache},
+			"fetch-jwt-custom-exp-claim.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, expTests, nil, func(output string) string {
+		parts := strings.Split(strings.TrimSpace(output), ".")
+		if len(parts) != 3 {
+			return output
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(payload, &claims) // nolint:errcheck
+		exp, _ := json.Marshal(claims["exp"])
+		return string(exp)
+	})
+
+	defer func(store util.CacheStore) { util.Cache = store }(util.Cache)
+	util.Cache, _ = util.ParseCacheStore(cache)
+	entries, err := util.ListCache()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single cached token, got %d: %v", len(entries), err)
+	}
+	if expiry := entries[0].Token.Expiry.Unix(); expiry != 4102444800 {
+		t.Fatalf("Expected cached token to expire at the exp claim, got %v", entries[0].Token.Expiry)
+	}
+}
+
+// Test self-signed JWTs signed with PEM, JWK and JWKS keys. Signatures are
+// verified with the public keys of the fixtures.
+func TestJWTSigningKeys(t *testing.T) {
+	rsaKey := "integration/fixtures/fake-rsa-key.pem"
+	ecKey := "integration/fixtures/fake-ec-key.pem"
+	ecJWK := "integration/fixtures/fake-ec-jwk.json"
+	rsaJWKS := "integration/fixtures/fake-rsa-jwks.json"
+	audience := "https://backend.example.com"
+	tests := []testCase{
+		{
+			"fetch; jwt; rsa pem",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", rsaKey,
+				"--issuer", "test-harness", "--cache", ""},
+			"fetch-jwt-rsa-pem.golden",
+			false,
+		},
+		{
+			"fetch; jwt; rsa pem; RS512 and kid",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", rsaKey,
+				"--alg", "RS512", "--kid", "my-key", "--cache", ""},
+			"fetch-jwt-rsa-pem-rs512.golden",
+			false,
+		},
+		{
+			"fetch; jwt; rsa pem; PS256",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", rsaKey,
+				"--alg", "PS256", "--cache", ""},
+			"fetch-jwt-rsa-pem-ps256.golden",
+			false,
+		},
+		{
+			"fetch; jwt; ec pem",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", ecKey, "--cache", ""},
+			"fetch-jwt-ec-pem.golden",
+			false,
+		},
+		{
+			"fetch; jwt; ec jwk",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", ecJWK,
+				"--subject", "user@example.com", "--cache", ""},
+			"fetch-jwt-ec-jwk.golden",
+			false,
+		},
+		{
+			"fetch; jwt; jwks; RS384",
+			[]string{"fetch", "--type", "jwt", "--scope", "pubsub", "--signing-key", rsaJWKS,
+				"--kid", "rsa-key-2", "--alg", "RS384", "--cache", ""},
+			"fetch-jwt-jwks.golden",
+			false,
+		},
+		{
+			"fetch; jwt; jwks; no kid",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", rsaJWKS, "--cache", ""},
+			"fetch-jwt-jwks-no-kid.golden",
+			false,
+		},
+		{
+			"fetch; jwt; jwks; unknown kid",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", rsaJWKS,
+				"--kid", "rsa-key-3", "--cache", ""},
+			"fetch-jwt-jwks-unknown-kid.golden",
+			false,
+		},
+		{
+			"fetch; jwt; ec pem; RS256",
+			[]string{"fetch", "--type", "jwt", "--audience", audience, "--signing-key", ecKey,
+				"--alg", "RS256", "--cache", ""},
+			"fetch-jwt-ec-pem-rs256.golden",
+			true,
+		},
+	}
+
+	// Returns the public key of the fixture that signed the JWT.
+	publicKey := func(header map[string]interface{}) crypto.PublicKey {
+		name, kid := "fake-rsa-key.pem", ""
+		switch header["kid"] {
+		case "ec-key-1":
+			name = "fake-ec-jwk.json"
+		case "rsa-key-1", "rsa-key-2":
+			name, kid = "fake-rsa-jwks.json", header["kid"].(string)
+		default:
+			if header["alg"] == util.AlgES256 {
+				name = "fake-ec-key.pem"
+			}
+		}
+		key, err := util.ParseSigningKey([]byte(newFixture(t, name).load()), kid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.Signer.Public()
+	}
+
+	// Returns true if the signature of the JWT is valid.
+	verify := func(header map[string]interface{}, parts []string) bool {
+		signed := []byte(parts[0] + "." + parts[1])
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hashes := map[string]crypto.Hash{
+			util.AlgRS256: crypto.SHA256, util.AlgRS384: crypto.SHA384, util.AlgRS512: crypto.SHA512,
+			util.AlgPS256: crypto.SHA256, util.AlgES256: crypto.SHA256, util.AlgES384: crypto.SHA384,
+		}
+		alg, _ := header["alg"].(string)
+		hash, ok := hashes[alg]
+		if !ok {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		digest := h.Sum(nil)
+		switch key := publicKey(header).(type) {
+		case *rsa.PublicKey:
+			if alg == util.AlgPS256 {
+				return rsa.VerifyPSS(key, hash, digest, sig, nil) == nil
+			}
+			return rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+		case *ecdsa.PublicKey:
+			size := len(sig) / 2
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			return ecdsa.Verify(key, digest, r, s)
+		}
+		return false
+	}
+
+	// JWT is signed with a timestamp that differs in every execution, so the
+	// "exp" and "iat" claims are replaced by the lifetime, and the signature
+	// by the result of its verification.
+	processJwtOutput := func(output string) string {
+		parts := strings.Split(strings.TrimSpace(output), ".")
+		if len(parts) != 3 {
+			return output
+		}
+		headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var header, claims map[string]interface{}
+		if err := json.Unmarshal(headerJSON, &header); err != nil {
+			return output
+		}
+		json.Unmarshal(payload, &claims) // nolint:errcheck
+		exp, _ := claims["exp"].(float64)
+		iat, _ := claims["iat"].(float64)
+		delete(claims, "exp")
+		delete(claims, "iat")
+		claims["lifetime"] = exp - iat
+		jsonString, _ := json.Marshal(claims)
+		result := "signature verified"
+		if !verify(header, parts) {
+			result = "invalid signature"
+		}
+		return string(headerJSON) + "\n" + string(jsonString) + "\n" + result
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processJwtOutput)
+}
+
+// Test OAuth 3LO device flow with fake client secrets. The mock device authorization
+// endpoint returns a polling interval of one second.
+func TestDeviceFlow(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; device",
+			[]string{"fetch", "--type", "device", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-client-secrets-device.json", "--cache", ""},
+			"fetch-device.golden",
+			false,
+		},
+		{
+			"header; device",
+			[]string{"header", "--type", "device", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-client-secrets-device.json", "--cache", ""},
+			"header-device.golden",
+			false,
+		},
+		{
+			"fetch; device; no credentials",
+			[]string{"fetch", "--type", "device", "--scope", "pubsub"},
+			"no-credentials-device.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+}
+
+// Test ID token flow with fake Service Account and authorized user credentials.
+func TestIDTokenFlow(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	tests := []testCase{
+		{
+			"fetch; idtoken; service account",
+			[]string{"fetch", "--type", "idtoken", "--audience", "https://service-abc123.a.run.app", "--credentials", "integration/fixtures/fake-service-account-idtoken.json", "--cache", ""},
+			"fetch-idtoken.golden",
+			false,
+		},
+		{
+			"fetch; idtoken; authorized user",
+			[]string{"fetch", "--type", "idtoken", "--audience", "https://service-abc123.a.run.app", "--credentials", "integration/fixtures/fake-authorized-user-idtoken.json", "--cache", ""},
+			"fetch-idtoken.golden",
+			false,
+		},
+		{
+			"fetch; idtoken; old interface",
+			[]string{"fetch", "--type", "idtoken", "--credentials", "integration/fixtures/fake-service-account-idtoken.json", "--cache", "", "https://service-abc123.a.run.app"},
+			"fetch-idtoken.golden",
+			false,
+		},
+		{
+			"header; idtoken",
+			[]string{"header", "--type", "idtoken", "--audience", "https://service-abc123.a.run.app", "--credentials", "integration/fixtures/fake-service-account-idtoken.json", "--cache", cache},
+			"header-idtoken.golden",
+			false,
+		},
+		{
+			"curl; idtoken",
+			[]string{"curl", "--type", "idtoken", "--audience", "https://service-abc123.a.run.app", "--credentials", "integration/fixtures/fake-service-account-idtoken.json", "--cache", cache,
+				"--url", "http://localhost:8080/curl", "--", "-s"},
+			"curl-idtoken.golden",
+			false,
+		},
+		{
+			"cache list; idtoken",
+			[]string{"cache", "list", "--cache", cache},
+			"cache-list-idtoken.golden",
+			false,
+		},
+		{
+			"fetch; idtoken; no audience",
+			[]string{"fetch", "--type", "idtoken", "--credentials", "integration/fixtures/fake-service-account-idtoken.json", "--cache", ""},
+			"no-audience-idtoken.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+}
+
+// Test SSO Flow. Uses "sh" to invoke fake ssocli to return a mock access token.
+func TestSSOFlow(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; sso",
+			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh"},
+			"fetch-sso.golden",
+			false,
+		},
+		{
+			"fetch; sso; old interface",
+			[]string{"fetch", "--sso", "--ssocli", "sh", "integration/fixtures/fake-ssocli.sh", "pubsub"},
+			"fetch-sso.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+}
+
+// Test RFC 8693 token exchange with subject tokens read from a file or stdin.
+func TestTokenExchange(t *testing.T) {
+	// Seed the cache with an expired token exchanged for another subject token,
+	// which is pruned when the new token is cached.
+	expired := util.CacheKey{TokenExchange: &util.TokenExchangeRequest{
+		Endpoint:         "http://localhost:8080/sts",
+		SubjectToken:     "expired-subject-token",
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:jwt",
+		Audience:         []string{"//iam.googleapis.com/example"},
+	}}
+	cache := writeTokenCacheWithKey(t, expired,
+		`{"access_token":"ya29.expired-token","token_type":"Bearer","expiry":"2020-01-01T00:00:00Z"}`, time.Now())
+	args := []string{"exchange", "--endpoint", "http://localhost:8080/sts", "--subject-token-type", "jwt",
+		"--scope", "https://www.googleapis.com/auth/cloud-platform", "--resource", "https://example.com/api"}
+
+	tests := []testCase{
+		{
+			"exchange; subject token file",
+			append(args, "--subject-token-file", "integration/fixtures/fake-subject-token",
+				"--audience", "//iam.googleapis.com/example", "--cache", cache),
+			"exchange.golden",
+			false,
+		},
+		{
+			"exchange; invalid target",
+			append(args, "--subject-token-file", "integration/fixtures/fake-subject-token",
+				"--audience", "invalid-audience", "--cache", ""),
+			"exchange-invalid-target.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	defer func(store util.CacheStore) { util.Cache = store }(util.Cache)
+	util.Cache, _ = util.ParseCacheStore(cache)
+	entries, err := util.ListCache()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected a single cached token, got %d: %v", len(entries), err)
+	}
+	if expiry := entries[0].Token.Expiry; time.Until(expiry) < 59*time.Minute || time.Until(expiry) > time.Hour {
+		t.Fatalf("Expected cached token to expire in 1h, got %v", expiry)
+	}
+
+	stdinTests := []testCase{
+		{
+			"exchange; subject token from stdin",
+			append(args, "--audience", "//iam.googleapis.com/example", "--cache", ""),
+			"exchange.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, stdinTests, newFixture(t, "fake-subject-token").asFile(), nil)
+
+	form, _ := lastTokenRequest.Load().(url.Values)
+	expected := map[string]string{
+		"grant_type":           "urn:ietf:params:oauth:grant-type:token-exchange",
+		"subject_token":        "fake-subject-token",
+		"subject_token_type":   "urn:ietf:params:oauth:token-type:jwt",
+		"requested_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"audience":             "//iam.googleapis.com/example",
+		"scope":                "https://www.googleapis.com/auth/cloud-platform",
+		"resource":             "https://example.com/api",
+	}
+	for k, v := range expected {
+		if actual := form.Get(k); actual != v {
+			t.Fatalf("Expected token exchange parameter %s=%s, got %s", k, v, actual)
+		}
+	}
+}
+
+// Test that tokens are downscoped with access boundaries given as a file or
+// inline rules, and cached separately from the source token.
+func TestAccessBoundary(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	args := []string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-service-account.json",
+		"--sts-endpoint", "http://localhost:8080/sts"}
+	options := `{"accessBoundary":{"accessBoundaryRules":[{` +
+		`"availableResource":"//storage.googleapis.com/projects/_/buckets/example-bucket",` +
+		`"availablePermissions":["inRole:roles/storage.objectViewer"],` +
+		`"availabilityCondition":{"expression":"resource.name.startsWith('projects/_/buckets/example-bucket/objects/builds/')"}}]}}`
+
+	tests := []testCase{
+		{
+			"fetch; 2lo; access boundary file",
+			append(args, "--access-boundary", "integration/fixtures/access-boundary.json", "--cache", cache),
+			"exchange.golden",
+			false,
+		},
+		{
+			"fetch; 2lo; invalid access boundary rule",
+			append(args, "--access-boundary-rule", "//storage.googleapis.com/projects/_/buckets/example-bucket"),
+			"access-boundary-invalid-rule.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	form, _ := lastTokenRequest.Load().(url.Values)
+	if actual := form.Get("options"); actual != options {
+		t.Fatalf("Expected options %s, got %s", options, actual)
+	}
+	defer func(store util.CacheStore) { util.Cache = store }(util.Cache)
+	util.Cache, _ = util.ParseCacheStore(cache)
+	entries, err := util.ListCache()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected the source and downscoped tokens to be cached, got %d: %v", len(entries), err)
+	}
+
+	inlineTests := []testCase{
+		{
+			"fetch; 2lo; inline access boundary rule",
+			append(args, "--access-boundary-rule", "//storage.googleapis.com/projects/_/buckets/example-bucket;roles/storage.objectViewer;"+
+				"resource.name.startsWith('projects/_/buckets/example-bucket/objects/builds/')", "--cache", ""),
+			"exchange.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, inlineTests)
+
+	form, _ = lastTokenRequest.Load().(url.Values)
+	if actual := form.Get("options"); actual != options {
+		t.Fatalf("Expected options %s, got %s", options, actual)
+	}
+}
+
+// Test Workload Identity Federation with file, URL and executable sourced
+// subject tokens, and Service Account impersonation.
+func TestExternalAccountFlow(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; external account; file source",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-file.json", "--cache", ""},
+			"exchange.golden",
+			false,
+		},
+		{
+			"fetch; external account; url source; impersonation",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-url.json", "--cache", ""},
+			"fetch-external-account-impersonation.golden",
+			false,
+		},
+		{
+			"fetch; external account; executable source; not allowed",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-executable.json", "--cache", ""},
+			"fetch-external-account-executable-not-allowed.golden",
+			true,
+		},
+		{
+			"fetch; external account; executable source",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-executable.json", "--cache", "",
+				"--allow-executables"},
+			"exchange.golden",
+			false,
+		},
+		{
+			"fetch; external account; executable source; cached response",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-executable-output-file.json", "--cache", ""},
+			"exchange.golden",
+			false,
+		},
+		{
+			"fetch; external account; pretty",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-url.json", "--cache", "",
+				"--output_format", "pretty"},
+			"fetch-external-account-pretty.golden",
+			false,
+		},
+		{
+			"fetch; external account; refresh token",
+			[]string{"fetch", "--scope", "cloud-platform", "--credentials", "integration/fixtures/fake-external-account-file.json", "--cache", "",
+				"--output_format", "refresh_token"},
+			"fetch-external-account-refresh-token.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+}
+
+// Test keyless federation with the OIDC tokens of GitHub Actions and GitLab CI jobs.
+func TestCIOIDCFlow(t *testing.T) {
+	provider := "projects/123456/locations/global/workloadIdentityPools/example-pool/providers/example-provider"
+	args := []string{"fetch", "--workload-identity-provider", provider, "--sts-endpoint", "http://localhost:8080/sts", "--cache", ""}
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "")
+	t.Setenv("GITLAB_OIDC_TOKEN", "fake-subject-token")
+	tests := []testCase{
+		{
+			"fetch; ci oidc; missing provider",
+			[]string{"fetch", "--ci-oidc", "github", "--cache", ""},
+			"ci-oidc-no-provider.golden",
+			false,
+		},
+		{
+			"fetch; ci oidc; github; missing request token",
+			append(args, "--ci-oidc", "github"),
+			"ci-oidc-github-no-env.golden",
+			true,
+		},
+		{
+			"fetch; ci oidc; gitlab",
+			append(args, "--ci-oidc", "gitlab"),
+			"exchange.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "http://localhost:8080/actionstoken?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "fake-request-token")
+	tests = []testCase{
+		{
+			"fetch; ci oidc; github",
+			append(args, "--ci-oidc", "github", "--scope", "pubsub"),
+			"exchange.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	form, _ := lastTokenRequest.Load().(url.Values)
+	expected := map[string]string{
+		"subject_token":      "fake-subject-token",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"audience":           "//iam.googleapis.com/" + provider,
+		"scope":              "https://www.googleapis.com/auth/pubsub",
+	}
+	for k, v := range expected {
+		if actual := form.Get(k); actual != v {
+			t.Fatalf("Expected token exchange parameter %s=%s, got %s", k, v, actual)
+		}
+	}
+}
+
+// Test access and ID tokens of the default Service Account of the metadata
+// server, emulated by the mock server.
+func TestMetadataFlow(t *testing.T) {
+	t.Setenv("GCE_METADATA_HOST", "localhost:8080")
+	tests := []testCase{
+		{
+			"fetch; metadata",
+			[]string{"fetch", "--type", "metadata", "--cache", ""},
+			"fetch-metadata.golden",
+			false,
+		},
+		{
+			"fetch; metadata; pretty",
+			[]string{"fetch", "--type", "metadata", "--output_format", "pretty", "--cache", ""},
+			"fetch-metadata-pretty.golden",
+			false,
+		},
+		{
+			"fetch; metadata; id token",
+			[]string{"fetch", "--type", "metadata", "--audience", "https://service-abc123.a.run.app", "--cache", ""},
+			"fetch-idtoken.golden",
+			false,
+		},
+		{
+			"fetch; metadata; scope",
+			[]string{"fetch", "--type", "metadata", "--scope", "pubsub", "--cache", ""},
+			"fetch-metadata.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	if scopes, _ := lastMetadataScopes.Load().(string); scopes != "https://www.googleapis.com/auth/pubsub" {
+		t.Fatalf("Expected metadata token request for the pubsub scope, got %s", scopes)
+	}
+}
+
+// Test API keys, which are printed and sent as is.
+func TestAPIKey(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; apikey",
+			[]string{"fetch", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey"},
+			"fetch-apikey.golden",
+			false,
+		},
+		{
+			"fetch; apikey; file",
+			[]string{"fetch", "--type", "apikey", "--api-key-file", "integration/fixtures/fake-api-key"},
+			"fetch-apikey-file.golden",
+			false,
+		},
+		{
+			"fetch; apikey; json",
+			[]string{"fetch", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey", "--output_format", "json"},
+			"fetch-apikey-json.golden",
+			true,
+		},
+		{
+			"fetch; apikey; missing key",
+			[]string{"fetch", "--type", "apikey"},
+			"fetch-apikey-missing.golden",
+			false,
+		},
+		{
+			"fetch; apikey; sts",
+			[]string{"fetch", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey", "--sts"},
+			"fetch-apikey-sts.golden",
+			false,
+		},
+		{
+			"header; apikey",
+			[]string{"header", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey"},
+			"header-apikey.golden",
+			false,
+		},
+		{
+			"curl; apikey",
+			[]string{"curl", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey", "--url", "http://localhost:8080/apikey",
+				"--", "-s"},
+			"curl-apikey.golden",
+			false,
+		},
+		{
+			"curl; apikey; param",
+			[]string{"curl", "--type", "apikey", "--api-key", "AIzaSyFakeApiKey", "--api-key-param",
+				"--url", "http://localhost:8080/apikey?language=en", "--", "-s"},
+			"curl-apikey-param.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+}
+
+// Test the client credentials grant and the authorization code flow with
+// PKCE against a generic OAuth 2.0 provider.
+func TestProviderFlow(t *testing.T) {
+	tokenURL := "http://localhost:8080/providertoken"
+	tests := []testCase{
+		{
+			"fetch; provider; invalid client",
+			[]string{"fetch", "--type", "provider", "--client-id", "provider-client", "--client-secret", "wrong-secret",
+				"--token-url", tokenURL, "--cache", ""},
+			"fetch-provider-invalid-client.golden",
+			true,
+		},
+		{
+			"fetch; provider; client credentials",
+			[]string{"fetch", "--type", "provider", "--client-id", "provider-client", "--client-secret", "provider-secret",
+				"--token-url", tokenURL, "--scope", "api.read,api.write", "--audience", "api://default", "--cache", ""},
+			"fetch-provider-client-credentials.golden",
+			false,
+		},
+		{
+			"fetch; provider; missing client id",
+			[]string{"fetch", "--type", "provider", "--token-url", tokenURL, "--cache", ""},
+			"fetch-provider-missing-client-id.golden",
+			true,
+		},
+		{
+			"fetch; provider; missing auth url",
+			[]string{"fetch", "--type", "provider", "--client-id", "provider-client", "--token-url", tokenURL,
+				"--grant-type", "authorization_code", "--cache", ""},
+			"fetch-provider-missing-auth-url.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	form, _ := lastTokenRequest.Load().(url.Values)
+	expected := map[string]string{
+		"grant_type": "client_credentials",
+		"scope":      "api.read api.write",
+		"audience":   "api://default",
+	}
+	for k, v := range expected {
+		if actual := form.Get(k); actual != v {
+			t.Fatalf("Expected %s %s, got %s", k, v, actual)
+		}
+	}
+
+	authCodeTests := []testCase{
+		{
+			"fetch; provider; authorization code",
+			[]string{"fetch", "--type", "provider", "--provider-file", "integration/fixtures/fake-provider.json", "--cache", ""},
+			"fetch-provider-authorization-code.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, authCodeTests, newFixture(t, "fake-verification-code.fixture").asFile(),
+		removeCodeChallenge)
+
+	form, _ = lastTokenRequest.Load().(url.Values)
+	if form.Get("grant_type") != "authorization_code" || form.Get("code_verifier") == "" {
+		t.Fatalf("Expected authorization code exchange with code verifier, got %v", form)
+	}
+
+	provider, _ := util.ParseProviderConfig([]byte(readFile("integration/fixtures/fake-provider.json")))
+	expired := `{"access_token":"provider-expired-token","token_type":"Bearer","refresh_token":"provider-refresh-token","expiry":"2000-01-01T00:00:00Z"}`
+	cache := writeTokenCacheWithKey(t, util.CacheKey{Provider: provider, Scope: "openid api.read"}, expired, time.Now())
+	refreshTests := []testCase{
+		{
+			"fetch; provider; refresh expired token",
+			[]string{"fetch", "--type", "provider", "--provider-file", "integration/fixtures/fake-provider.json", "--cache", cache},
+			"fetch-provider-refreshed.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, refreshTests)
+
+	form, _ = lastTokenRequest.Load().(url.Values)
+	if form.Get("grant_type") != "refresh_token" || form.Get("refresh_token") != "provider-refresh-token" {
+		t.Fatalf("Expected refresh of the cached token, got %v", form)
+	}
+}
+
+// Test the discovery of provider endpoints from the OpenID Connect issuer,
+// and the caching of the discovery document.
+func TestIssuerDiscovery(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	issuer := "http://localhost:8080/issuer"
+	clientArgs := []string{"--client-id", "provider-client", "--client-secret", "provider-secret"}
+	tests := []testCase{
+		{
+			"fetch; issuer; client credentials",
+			append([]string{"fetch", "--type", "provider", "--issuer", issuer, "--grant-type", "client_credentials"}, clientArgs...),
+			"fetch-provider-client-credentials.golden",
+			false,
+		},
+		{
+			"fetch; issuer; client credentials; cached discovery",
+			append([]string{"fetch", "--type", "provider", "--issuer", issuer + "/", "--grant-type", "client_credentials"}, clientArgs...),
+			"fetch-provider-client-credentials.golden",
+			false,
+		},
+		{
+			"fetch; issuer; no pkce",
+			append([]string{"fetch", "--type", "provider", "--issuer", "http://localhost:8080/issuer-nopkce"}, clientArgs...),
+			"fetch-issuer-no-pkce.golden",
+			true,
+		},
+		{
+			"fetch; issuer; mismatch",
+			append([]string{"fetch", "--type", "provider", "--issuer", "http://localhost:8080/issuer-mismatch"}, clientArgs...),
+			"fetch-issuer-mismatch.golden",
+			true,
+		},
+		{
+			"info; issuer",
+			[]string{"info", "--issuer", issuer, "--token", "provider-client-credentials-token"},
+			"info-issuer.golden",
+			false,
+		},
+		{
+			"test; issuer; invalid token",
+			[]string{"test", "--issuer", issuer, "--token", "invalid-token"},
+			"test-issuer-invalid-token.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	if count := atomic.LoadInt32(&discoveryRequests); count != 1 {
+		t.Fatalf("Expected the discovery document to be fetched once, got %d", count)
+	}
+
+	// Discovery documents are not cached if caching is disabled.
+	noCacheTests := []testCase{
+		{
+			"fetch; issuer; client credentials; no cache",
+			append([]string{"fetch", "--type", "provider", "--issuer", issuer, "--grant-type", "client_credentials",
+				"--cache", ""}, clientArgs...),
+			"fetch-provider-client-credentials.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, noCacheTests)
+
+	if count := atomic.LoadInt32(&discoveryRequests); count != 2 {
+		t.Fatalf("Expected the discovery document to be fetched twice, got %d", count)
+	}
+	if _, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".oauth2l-discovery")); err != nil {
+		t.Fatalf("Expected discovery documents to be cached next to the token cache: %v", err)
+	}
+
+	authCodeTests := []testCase{
+		{
+			"fetch; issuer; authorization code",
+			append([]string{"fetch", "--type", "provider", "--issuer", issuer, "--redirect-uri", "urn:ietf:wg:oauth:2.0:oob",
+				"--scope", "openid"}, clientArgs...),
+			"fetch-issuer-authorization-code.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, authCodeTests, newFixture(t, "fake-verification-code.fixture").asFile(),
+		removeCodeChallenge)
+}
+
+// Test the revocation of given and cached tokens, and the removal of the
+// revoked tokens from the cache.
+func TestRevoke(t *testing.T) {
+	credentials := "integration/fixtures/fake-client-secrets-revoke-uri.json"
+	pubsub := "https://www.googleapis.com/auth/pubsub"
+	cached := `{"access_token":"ya29.cached-token","token_type":"Bearer","refresh_token":"1/cached-refresh-token","expiry":"2999-01-01T00:00:00Z"}`
+	cache := writeTokenCache(t, credentials, pubsub, cached, time.Now())
+	tests := []testCase{
+		{
+			"revoke; cached token",
+			[]string{"revoke", "--scope", "pubsub", "--credentials", credentials, "--cache", cache},
+			"revoke.golden",
+			false,
+		},
+		{
+			"revoke; not cached",
+			[]string{"revoke", "--scope", "pubsub", "--credentials", credentials, "--cache", cache},
+			"revoke-not-cached.golden",
+			true,
+		},
+		{
+			"revoke; token",
+			[]string{"revoke", "--token", "ya29.given-token", "--credentials", credentials, "--cache", ""},
+			"revoke.golden",
+			false,
+		},
+		{
+			"revoke; jwt",
+			[]string{"revoke", "--type", "jwt", "--audience", "https://pubsub.googleapis.com/",
+				"--credentials", "integration/fixtures/fake-service-account.json", "--cache", ""},
+			"revoke-jwt.golden",
+			true,
+		},
+		{
+			"revoke; sts",
+			[]string{"revoke", "--scope", "pubsub", "--sts",
+				"--credentials", "integration/fixtures/fake-service-account.json", "--cache", ""},
+			"revoke-sts.golden",
+			true,
+		},
+		{
+			"revoke; provider token",
+			[]string{"revoke", "--type", "provider", "--issuer", "http://localhost:8080/issuer", "--client-id", "provider-client",
+				"--client-secret", "provider-secret", "--token", "provider-refresh-token", "--cache", ""},
+			"revoke.golden",
+			false,
+		},
+		{
+			"revoke; provider token; invalid client",
+			[]string{"revoke", "--type", "provider", "--issuer", "http://localhost:8080/issuer", "--client-id", "other-client",
+				"--client-secret", "provider-secret", "--token", "provider-refresh-token", "--cache", ""},
+			"revoke-invalid-client.golden",
+			true,
+		},
+		{
+			"revoke; provider token; no revocation endpoint",
+			[]string{"revoke", "--type", "provider", "--token-url", "http://localhost:8080/token", "--client-id", "provider-client",
+				"--token", "provider-refresh-token", "--cache", ""},
+			"revoke-no-revocation-endpoint.golden",
+			true,
+		},
+	}
+	t.Setenv("HOME", t.TempDir())
+	runTestScenarios(t, tests)
+
+	expected := []string{"ya29.cached-token", "1/cached-refresh-token", "ya29.given-token", "provider-refresh-token"}
+	if actual := revokedTokens.Load(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected revoked tokens %v, got %v", expected, actual)
+	}
+
+	defer func(store util.CacheStore) { util.Cache = store }(util.Cache)
+	util.Cache, _ = util.ParseCacheStore(cache)
+	if entries, err := util.ListCache(); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected revoked token to be removed from the cache, got %d: %v", len(entries), err)
+	}
+}
+
+// Test that reset --revoke revokes all revocable tokens before resetting
+// the cache, and fails if any token cannot be revoked.
+func TestResetRevoke(t *testing.T) {
+	revokedTokens.Store([]string(nil))
+	credentials := readFile("integration/fixtures/fake-client-secrets-revoke-uri.json")
+	cache := filepath.Join(t.TempDir(), "oauth2l-cache")
+	defer func(store util.CacheStore) { util.Cache = store }(util.Cache)
+	util.Cache, _ = util.ParseCacheStore(cache)
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Scope: "https://www.googleapis.com/auth/pubsub"},
+		&oauth2.Token{AccessToken: "ya29.first-token", RefreshToken: "1/first-refresh-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Scope: "https://www.googleapis.com/auth/jwt", AuthType: util.AuthTypeJWT},
+		&oauth2.Token{AccessToken: "jwt-token"})
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Audience: "https://example.com", AuthType: util.AuthTypeIDToken},
+		&oauth2.Token{AccessToken: "id-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{Audience: "https://example.com", AuthType: util.AuthTypeMetadata},
+		&oauth2.Token{AccessToken: "metadata-id-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{Scope: "https://www.googleapis.com/auth/pubsub", AuthType: util.AuthTypeMetadata},
+		&oauth2.Token{AccessToken: "ya29.metadata-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Scope: "https://www.googleapis.com/auth/pubsub", Sts: true},
+		&oauth2.Token{AccessToken: "ya29.sts-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{Scope: "https://www.googleapis.com/auth/pubsub", AuthType: util.AuthTypeCIOIDC,
+		CIProvider: "github", WorkloadIdentityProvider: "projects/123/locations/global/workloadIdentityPools/pool/providers/github"},
+		&oauth2.Token{AccessToken: "ya29.federated-token", Expiry: time.Now().Add(time.Hour)})
+
+	tests := []testCase{
+		{
+			"reset; revoke",
+			[]string{"reset", "--revoke", "--cache", cache},
+			"reset-revoke.golden",
+			false,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	expected := []string{"ya29.first-token", "1/first-refresh-token"}
+	if actual := revokedTokens.Load(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected revoked tokens %v, got %v", expected, actual)
+	}
+	if entries, err := util.ListCache(); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected cache to be reset, got %d: %v", len(entries), err)
+	}
+
+	// The revocation endpoint of the credentials does not exist. The token
+	// that failed to be revoked is kept in the cache, the others are deleted.
+	util.InsertCache(&util.Settings{CredentialsJSON: strings.Replace(credentials, "/revoke", "/revoke-missing", 1),
+		Scope: "https://www.googleapis.com/auth/pubsub"},
+		&oauth2.Token{AccessToken: "ya29.second-token", RefreshToken: "1/second-refresh-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Scope: "https://www.googleapis.com/auth/cloud-platform"},
+		&oauth2.Token{AccessToken: "ya29.third-token", Expiry: time.Now().Add(time.Hour)})
+	util.InsertCache(&util.Settings{CredentialsJSON: credentials, Scope: "https://www.googleapis.com/auth/jwt", AuthType: util.AuthTypeJWT},
+		&oauth2.Token{AccessToken: "jwt-token"})
+	failureTests := []testCase{
+		{
+			"reset; revoke; failure",
+			[]string{"reset", "--revoke", "--cache", cache},
+			"reset-revoke-failure.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, failureTests)
+
+	entries, err := util.ListCache()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected the failed token to be kept, got %d: %v", len(entries), err)
+	}
+	if token := entries[0].Token; token.AccessToken != "ya29.second-token" || token.RefreshToken != "1/second-refresh-token" {
+		t.Fatalf("Expected the failed token to be kept, got %v", token.AccessToken)
+	}
+}
+
+// Test signing of payloads and JWT claims with local keys. Signatures of
+// RSA PKCS #1 v1.5 keys are deterministic, so they are compared as is.
+func TestSign(t *testing.T) {
+	serviceAccount := "integration/fixtures/fake-service-account.json"
+	payload := "integration/fixtures/fake-payload"
+	claims := "integration/fixtures/fake-claims.json"
+	tests := []testCase{
+		{
+			"sign; service account",
+			[]string{"sign", "--payload", payload, "--credentials", serviceAccount},
+			"sign.golden",
+			false,
+		},
+		{
+			"sign; service account; json",
+			[]string{"sign", "--payload", payload, "--credentials", serviceAccount, "--output_format", "json"},
+			"sign-json.golden",
+			false,
+		},
+		{
+			"sign; jwt; service account",
+			[]string{"sign", "--jwt", "--payload", claims, "--credentials", serviceAccount},
+			"sign-jwt.golden",
+			false,
+		},
+		{
+			"sign; jwt; jwks; json",
+			[]string{"sign", "--jwt", "--payload", claims, "--signing-key", "integration/fixtures/fake-rsa-jwks.json",
+				"--kid", "rsa-key-1", "--output_format", "json"},
+			"sign-jwt-jwks-json.golden",
+			false,
+		},
+		{
+			"sign; jwt; invalid claims",
+			[]string{"sign", "--jwt", "--payload", payload, "--credentials", serviceAccount},
+			"sign-jwt-invalid-claims.golden",
+			true,
+		},
+		{
+			"sign; jwt; missing signing key",
+			[]string{"sign", "--jwt", "--payload", claims, "--signing-key", "integration/fixtures/nonexistent"},
+			"sign-missing-signing-key.golden",
+			true,
+		},
+		{
+			"sign; user credentials",
+			[]string{"sign", "--payload", payload, "--credentials", "integration/fixtures/fake-authorized-user-idtoken.json"},
+			"sign-user-credentials.golden",
+			true,
+		},
+		{
+			"sign; impersonation; signing key",
+			[]string{"sign", "--payload", payload, "--impersonate-service-account", "sa@example.iam.gserviceaccount.com",
+				"--signing-key", "integration/fixtures/fake-rsa-key.pem"},
+			"sign-impersonation-signing-key.golden",
+			true,
+		},
+		{
+			"sign; delegates",
+			[]string{"sign", "--payload", payload, "--credentials", serviceAccount, "--delegates", "other@example.iam.gserviceaccount.com"},
+			"sign-delegates.golden",
+			true,
+		},
+	}
+	runTestScenarios(t, tests)
+
+	// The payload is read from stdin if not set.
+	stdinTests := []testCase{
+		{
+			"sign; stdin",
+			[]string{"sign", "--credentials", serviceAccount},
+			"sign.golden",
+			false,
+		},
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, stdinTests, newFixture(t, "fake-payload").asFile(), nil)
+}
+
+// Test STS Flow.
+func TestStsFlow(t *testing.T) {
+	tests := []testCase{
+		{
+			"fetch; 2lo; sts",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json", "--sts", "--audience", "http://test.com", "--quota_project", "TestQuotaProject", "--output_format", "json"},
+			"fetch-sts.golden",
+			false,
+		},
+		{
+			"fetch; sso; sts",
+			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh", "--sts", "--audience", "http://test.com", "--quota_project", "TestQuotaProject", "--output_format", "json"},
+			"fetch-sts.golden",
+			false,
+		},
+	}
+
+	processStsOutput := func(sts string) string {
+		//STS token differs in every execution even for the same subject token, so we will strip out "access_token" field.
+		var jsonData map[string]interface{}
+		json.Unmarshal([]byte(sts), &jsonData) // nolint:errcheck
+		delete(jsonData, "access_token")
+		jsonString, _ := json.Marshal(jsonData)
+		return string(jsonString)
+	}
+	runTestScenariosWithInputAndProcessedOutput(t, tests, nil, processStsOutput)
+}
+
+// Test Service Account Impersonation Flow.
+// This currently sends request to the real IAM endpoint, which will return 401 for having invalid user access token, which is expected.
+func TestServiceAccountImpersonationFlow(t *testing.T) {
+
+	tests := []testCase{
+		{
+			"fetch; sso; impersonation",
+			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh", "--impersonate-service-account", "12345"},
+			"fetch-impersonation.golden",
+			false,
+		},
+		{
+			"fetch; sso; impersonation; delegates",
+			[]string{"fetch", "--type", "sso", "--email", "integration/fixtures/fake-ssocli.sh", "--scope", "pubsub", "--ssocli", "sh", "--impersonate-service-account", "12345",
+				"--delegates", "67890", "--impersonate-lifetime", "30m"},
+			"fetch-impersonation.golden",
+			false,
+		},
+		{
+			"fetch; jwt; impersonation",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials",
+				"integration/fixtures/fake-service-account.json", "--impersonate-service-account", "sa@example.iam.gserviceaccount.com",
+				"--delegates", "delegate@example.iam.gserviceaccount.com", "--iam-endpoint", "http://localhost:8080", "--cache", ""},
+			"fetch-jwt-impersonation.golden",
+			false,
+		},
+		{
+			"fetch; jwt; impersonation; permission denied",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--credentials",
+				"integration/fixtures/fake-service-account.json", "--impersonate-service-account", "denied@example.iam.gserviceaccount.com",
+				"--iam-endpoint", "http://localhost:8080", "--cache", ""},
+			"fetch-jwt-impersonation-permission-denied.golden",
+			true,
+		},
+		{
+			"fetch; jwt; impersonation; signing key; rejected",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--impersonate-service-account",
+				"sa@example.iam.gserviceaccount.com", "--signing-key", "integration/fixtures/fake-rsa-key.pem", "--cache", ""},
+			"fetch-jwt-impersonation-signing-key.golden",
+			true,
+		},
+		{
+			"fetch; jwt; impersonation; impersonate lifetime; rejected",
+			[]string{"fetch", "--type", "jwt", "--audience", "https://backend.example.com", "--impersonate-service-account",
+				"sa@example.iam.gserviceaccount.com", "--impersonate-lifetime", "30m", "--cache", ""},
+			"fetch-jwt-impersonation-lifetime.golden",
+			true,
+		},
+		{
+			"fetch; idtoken; impersonation; impersonate lifetime; rejected",
+			[]string{"fetch", "--type", "idtoken", "--audience", "https://backend.example.com", "--credentials",
+				"integration/fixtures/fake-service-account.json", "--impersonate-service-account",
+				"sa@example.iam.gserviceaccount.com", "--impersonate-lifetime", "30m", "--cache", ""},
+			"fetch-idtoken-impersonation-lifetime.golden",
+			true,
+		},
+		{
+			"fetch; metadata; idtoken; impersonation; impersonate lifetime; rejected",
+			[]string{"fetch", "--type", "metadata", "--audience", "https://backend.example.com", "--impersonate-service-account",
+				"sa@example.iam.gserviceaccount.com", "--impersonate-lifetime", "30m", "--cache", ""},
+			"fetch-idtoken-impersonation-lifetime.golden",
+			true,
+		},
+		{
+			"fetch; impersonation; negative lifetime; rejected",
+			[]string{"fetch", "--scope", "pubsub", "--credentials", "integration/fixtures/fake-service-account.json",
+				"--impersonate-service-account", "sa@example.iam.gserviceaccount.com", "--impersonate-lifetime", "-30m", "--cache", ""},
+			"fetch-impersonation-negative-lifetime.golden",
+			true,
+		},
+	}
+
+	runTestScenarios(t, tests)
+
+	// The JWT is signed by IAM as the Service Account, through the delegates.
+	body, _ := lastSignJwtRequest.Load().(map[string]interface{})
+	if delegates := body["delegates"]; !reflect.DeepEqual(delegates,
+		[]interface{}{"projects/-/serviceAccounts/delegate@example.iam.gserviceaccount.com"}) {
+		t.Fatalf("Expected delegates to be sent to signJwt, got %v", delegates)
+	}
+	var claims map[string]interface{}
+	payload, _ := body["payload"].(string)
+	if err := json.Unmarshal([]byte(payload), &claims); err != nil {
+		t.Fatalf("Expected JSON claims to be sent to signJwt, got %q: %v", payload, err)
+	}
+	for name, value := range map[string]string{"iss": "sa@example.iam.gserviceaccount.com",
+		"sub": "sa@example.iam.gserviceaccount.com", "aud": "https://backend.example.com"} {
+		if claims[name] != value {
+			t.Fatalf("Expected claim %s to be %q, got %v", name, value, claims[name])
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	iat, _ := claims["iat"].(float64)
+	if exp-iat != 3600 {
+		t.Fatalf("Expected the JWT to be valid for 1h, got %v", exp-iat)
+	}
+}
+
+// getCredentialsFileName finds the credentials filename provided in the testCase arguments.
+// If no filename is found, an empty string is returned.
+//
+// Note: the "--credentials" or "--json" options are used to find the credentials file.
+//
+// input tc: is the test case.
+func getCredentialsFileName(tc *testCase) string {
+	var a string
+	var i int
+	for i, a = range tc.args {
+		if a == "--credentials" || a == "--json" {
+			break
+		}
+	}
+	if i >= len(tc.args)-1 {
+		return ""
+	}
+	return path.Base(tc.args[i+1])
+}
+
+// changeCredentialsFileName replaces the credentials filename in the test arguments.
+// If the credentials file is not found, no changes are made.
+//
+// input tc: is the test case.
+// input filename: is the new filename.
+func changeCredentialsFileName(tc *testCase, filename string) {
+	var a string
+	var i int
+	for i, a = range tc.args {
+		if a == "--credentials" || a == "--json" {
+			break
+		}
+	}
+	if i >= len(tc.args)-1 {
+		return
+	}
+	dir := path.Dir(tc.args[i+1])
+	tc.args[i+1] = dir + "/" + filename
+}
+
+func readFile(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("could not read file %s: %v", path, err)
+	}
+	return string(content)
+}
+
+// Form of the last request served by MockTokenApi.
+var lastTokenRequest atomic.Value
+
+// Access token returned by MockTokenApi.
+const mockAccessToken = "ya29.GltDB_y4Oz8lVB5diZu9YVMgHuXoSVBXx6jt7WU9n8IaXk63RejERFtx2LfrH-VL51CbaAxKsC8EoMZXg50h2QvOcUQ-YZTvFnKtIJpLj_Zj68M56_VagXpZkZd7"
+
 func MockTokenApi(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	lastTokenRequest.Store(r.PostForm)
 	w.Header().Set("Content-Type", "application/json")
 	response := readFile("integration/fixtures/mock-token-response.json")
 	fmt.Fprint(w, response)
 }
 
+func MockProviderTokenApi(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	lastTokenRequest.Store(r.PostForm)
+	w.Header().Set("Content-Type", "application/json")
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientID != "provider-client" || clientSecret != "provider-secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+	switch r.FormValue("grant_type") {
+	case "client_credentials":
+		fmt.Fprint(w, `{"access_token":"provider-client-credentials-token","expires_in":3600,"token_type":"Bearer"}`)
+	case "authorization_code":
+		fmt.Fprint(w, `{"access_token":"provider-authorization-code-token","refresh_token":"provider-refresh-token","expires_in":3600,"token_type":"Bearer"}`)
+	case "refresh_token":
+		fmt.Fprint(w, `{"access_token":"provider-refreshed-token","expires_in":3600,"token_type":"Bearer"}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"unsupported_grant_type"}`)
+	}
+}
+
+// Number of discovery documents of http://localhost:8080/issuer served by
+// MockDiscoveryApi.
+var discoveryRequests int32
+
+func MockDiscoveryApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	issuer := "http://localhost:8080" + strings.TrimSuffix(r.URL.Path, "/.well-known/openid-configuration")
+	if issuer == "http://localhost:8080/issuer" {
+		atomic.AddInt32(&discoveryRequests, 1)
+	}
+	doc := map[string]interface{}{
+		"issuer":                           issuer,
+		"authorization_endpoint":           "https://provider.example.com/oauth2/v1/authorize",
+		"token_endpoint":                   "http://localhost:8080/providertoken",
+		"userinfo_endpoint":                "http://localhost:8080/userinfo",
+		"revocation_endpoint":              "http://localhost:8080/revoke",
+		"jwks_uri":                         "http://localhost:8080/jwks",
+		"grant_types_supported":            []string{"authorization_code", "client_credentials", "refresh_token"},
+		"code_challenge_methods_supported": []string{"S256"},
+	}
+	switch issuer {
+	case "http://localhost:8080/issuer-nopkce":
+		doc["code_challenge_methods_supported"] = []string{"plain"}
+	case "http://localhost:8080/issuer-mismatch":
+		doc["issuer"] = "https://attacker.example.com"
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func MockUserinfoApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer provider-client-credentials-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_token"}`)
+		return
+	}
+	fmt.Fprint(w, `{"sub":"provider-client","email":"client@example.com"}`)
+}
+
+// Tokens revoked by MockRevokeApi, in order.
+var revokedTokens revokedTokenList
+
+type revokedTokenList struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (l *revokedTokenList) Store(tokens []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = tokens
+}
+
+func (l *revokedTokenList) Load() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tokens
+}
+
+func MockRevokeApi(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+	if clientID, _, ok := r.BasicAuth(); ok && clientID != "provider-client" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_client"}`)
+		return
+	}
+	revokedTokens.mu.Lock()
+	defer revokedTokens.mu.Unlock()
+	revokedTokens.tokens = append(revokedTokens.tokens, r.FormValue("token"))
+	fmt.Fprint(w, "{}")
+}
+
+func MockStsApi(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	lastTokenRequest.Store(r.PostForm)
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("audience") == "invalid-audience" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid_target","error_description":"The audience is not allowed."}`)
+		return
+	}
+	response := readFile("integration/fixtures/mock-sts-response.json")
+	fmt.Fprint(w, response)
+}
+
+func MockSubjectTokenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"id_token":"fake-subject-token"}`)
+}
+
+// Dispatches the requests to the IAM Service Account Credentials API by method.
+func MockIamApi(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ":signJwt") {
+		MockSignJwtApi(w, r)
+		return
+	}
+	MockGenerateAccessTokenApi(w, r)
+}
+
+// Body of the last request served by MockSignJwtApi.
+var lastSignJwtRequest atomic.Value
+
+func MockSignJwtApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer "+mockAccessToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"code":401,"message":"Request had invalid authentication credentials.","status":"UNAUTHENTICATED"}}`)
+		return
+	}
+	if strings.HasPrefix(path.Base(r.URL.Path), "denied@") {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"code":403,"message":"Permission 'iam.serviceAccounts.signJwt' denied.","status":"PERMISSION_DENIED"}}`)
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	lastSignJwtRequest.Store(body)
+	fmt.Fprint(w, `{"keyId":"fake-key-id","signedJwt":"fake-signed-jwt"}`)
+}
+
+func MockGenerateAccessTokenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer ya29.exchanged-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":{"code":401,"message":"Request had invalid authentication credentials.","status":"UNAUTHENTICATED"}}`)
+		return
+	}
+	fmt.Fprint(w, `{"accessToken":"ya29.impersonated-token","expireTime":"2999-01-01T00:00:00Z"}`)
+}
+
+func MockActionsTokenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer fake-request-token" ||
+		!strings.HasPrefix(r.URL.Query().Get("audience"), "https://iam.googleapis.com/projects/") {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"message":"Bad credentials"}`)
+		return
+	}
+	fmt.Fprint(w, `{"value":"fake-subject-token"}`)
+}
+
+// Scopes of the last token request served by MockMetadataApi.
+var lastMetadataScopes atomic.Value
+
+func MockMetadataApi(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Metadata-Flavor", "Google")
+	switch strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/instance/service-accounts/default/") {
+	case "token":
+		lastMetadataScopes.Store(r.URL.Query().Get("scopes"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"ya29.metadata-token","expires_in":3599,"token_type":"Bearer"}`)
+	case "identity":
+		if r.URL.Query().Get("audience") != "https://service-abc123.a.run.app" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var response map[string]interface{}
+		json.Unmarshal([]byte(readFile("integration/fixtures/mock-id-token-response.json")), &response)
+		fmt.Fprint(w, response["id_token"])
+	case "email":
+		fmt.Fprint(w, "default@example.iam.gserviceaccount.com")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 func MockExpiredTokenApi(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	response := readFile("integration/fixtures/mock-expired-token-response.json")
 	fmt.Fprint(w, response)
 }
 
+// Rejects refresh tokens as revoked, and issues tokens for other grants.
+func MockRevokedRefreshTokenApi(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") == "refresh_token" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+		return
+	}
+	MockTokenApi(w, r)
+}
+
+func MockUnavailableTokenApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, `{"error": "temporarily_unavailable", "error_description": "The service is temporarily unavailable."}`)
+}
+
+// Issues ID tokens for signed JWTs with a target audience, and for refresh tokens.
+func MockIdTokenApi(w http.ResponseWriter, r *http.Request) {
+	if assertion := r.FormValue("assertion"); assertion != "" {
+		var claims map[string]interface{}
+		parts := strings.Split(assertion, ".")
+		if len(parts) == 3 {
+			payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			json.Unmarshal(payload, &claims)
+		}
+		if claims["target_audience"] != "https://service-abc123.a.run.app" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_request", "error_description": "Missing target_audience."}`)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response := readFile("integration/fixtures/mock-id-token-response.json")
+	fmt.Fprint(w, response)
+}
+
+// Number of requests served by MockSlowTokenApi.
+var slowTokenRequests int32
+
+func MockSlowTokenApi(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&slowTokenRequests, 1)
+	time.Sleep(500 * time.Millisecond)
+	MockTokenApi(w, r)
+}
+
+func MockDeviceCodeApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := readFile("integration/fixtures/mock-device-code-response.json")
+	fmt.Fprint(w, response)
+}
+
+// Echoes the API key and whether it was sent as header or query parameter.
+func MockAPIKeyApi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	source, key := "header", r.Header.Get("X-Goog-Api-Key")
+	if key == "" {
+		source, key = "param", r.URL.Query().Get("key")
+	}
+	fmt.Fprintf(w, `{"source":%q,"key":%q,"language":%q}`+"\n", source, key, r.URL.Query().Get("language"))
+}
+
 func MockCurlApi(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	response := "{}"
@@ -796,7 +2718,24 @@ func TestMain(m *testing.M) {
 		server := http.Server{Addr: "localhost:8080", Handler: mux}
 		mux.HandleFunc("/token", MockTokenApi)
 		mux.HandleFunc("/expiredtoken", MockExpiredTokenApi)
+		mux.HandleFunc("/slowtoken", MockSlowTokenApi)
+		mux.HandleFunc("/revokedtoken", MockRevokedRefreshTokenApi)
+		mux.HandleFunc("/unavailabletoken", MockUnavailableTokenApi)
+		mux.HandleFunc("/idtoken", MockIdTokenApi)
+		mux.HandleFunc("/device/code", MockDeviceCodeApi)
 		mux.HandleFunc("/curl", MockCurlApi)
+		mux.HandleFunc("/apikey", MockAPIKeyApi)
+		mux.HandleFunc("/sts", MockStsApi)
+		mux.HandleFunc("/providertoken", MockProviderTokenApi)
+		mux.HandleFunc("/issuer/", MockDiscoveryApi)
+		mux.HandleFunc("/issuer-nopkce/", MockDiscoveryApi)
+		mux.HandleFunc("/issuer-mismatch/", MockDiscoveryApi)
+		mux.HandleFunc("/userinfo", MockUserinfoApi)
+		mux.HandleFunc("/revoke", MockRevokeApi)
+		mux.HandleFunc("/subjecttoken", MockSubjectTokenApi)
+		mux.HandleFunc("/actionstoken", MockActionsTokenApi)
+		mux.HandleFunc("/computeMetadata/v1/", MockMetadataApi)
+		mux.HandleFunc("/v1/projects/-/serviceAccounts/", MockIamApi)
 		if err := server.ListenAndServe(); err != nil {
 			fmt.Printf("could not listen on port 8080 %v", err)
 		}
@@ -0,0 +1,2 @@
+#!/bin/sh
+echo '{"version": 1, "success": true, "token_type": "urn:ietf:params:oauth:token-type:jwt", "id_token": "fake-subject-token", "expiration_time": 4102444800}'
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -47,54 +48,117 @@ var (
 
 // Top level command-line flags (first argument after program name).
 type commandOptions struct {
-	Fetch  fetchOptions  `command:"fetch" description:"Fetch an access token."`
-	Header headerOptions `command:"header" description:"Fetch an access token and return it in header format."`
-	Curl   curlOptions   `command:"curl" description:"Fetch an access token and use it to make a curl request."`
-	Info   infoOptions   `command:"info" description:"Display info about an OAuth access token."`
-	Test   infoOptions   `command:"test" description:"Tests an OAuth access token. Returns 0 for valid token."`
-	Reset  resetOptions  `command:"reset" description:"Resets the cache."`
-	Web    webOptions    `command:"web"   description:"Launches a local instance of the OAuth2l Playground web app. This feature is experimental."`
+	Fetch    fetchOptions    `command:"fetch" description:"Fetch an access token."`
+	Header   headerOptions   `command:"header" description:"Fetch an access token and return it in header format."`
+	Curl     curlOptions     `command:"curl" description:"Fetch an access token and use it to make a curl request."`
+	Exchange exchangeOptions `command:"exchange" description:"Exchange a token for another token using RFC 8693 token exchange."`
+	Info     infoOptions     `command:"info" description:"Display info about an OAuth access token."`
+	Test     infoOptions     `command:"test" description:"Tests an OAuth access token. Returns 0 for valid token."`
+	Revoke   revokeOptions   `command:"revoke" description:"Revoke a token, or the cached token for the given arguments, and remove it from the cache."`
+	Sign     signOptions     `command:"sign" description:"Sign a payload or JWT claims with a Service Account or signing key."`
+	Reset    resetOptions    `command:"reset" description:"Resets the cache."`
+	Cache    cacheOptions    `command:"cache" description:"Lists, shows, or deletes cached tokens."`
+	Web      webOptions      `command:"web"   description:"Launches a local instance of the OAuth2l Playground web app. This feature is experimental."`
 }
 
-// Common options for "fetch", "header", and "curl" commands.
+// Common options for "fetch", "header", "curl" and "revoke" commands.
 type commonFetchOptions struct {
-	// Currently there are 3 authentication types that are mutually exclusive:
+	// Currently there are 8 authentication types that are mutually exclusive:
 	//
 	// oauth - Executes 2LO flow for Service Account and 3LO flow for OAuth Client ID. Returns OAuth token.
 	// jwt - Signs claims (in JWT format) using PK. Returns signature as token. Only works for Service Account.
 	// sso - Exchanges LOAS credential to OAuth token.
-	AuthType string `long:"type" choice:"oauth" choice:"jwt" choice:"sso" description:"The authentication type." default:"oauth"`
+	// device - Executes the device authorization flow for OAuth Client ID. Returns OAuth token.
+	// idtoken - Fetches an OpenID Connect ID token for the audience. Returns ID token.
+	// metadata - Fetches a token of the default Service Account from the metadata server. Returns OAuth or ID token.
+	// apikey - Uses the given Google API key as is. Returns API key.
+	// provider - Executes client credentials grant or 3LO flow with PKCE against a generic OAuth 2.0 provider. Returns OAuth token.
+	AuthType string `long:"type" choice:"oauth" choice:"jwt" choice:"sso" choice:"device" choice:"idtoken" choice:"metadata" choice:"apikey" choice:"provider" description:"The authentication type." default:"oauth"`
 
 	// GUAC parameters
-	Credentials    string `long:"credentials" description:"Credentials file containing OAuth Client Id or Service Account Key. Optional if environment variable GOOGLE_APPLICATION_CREDENTIALS is set."`
-	Scope          string `long:"scope" description:"List of OAuth scopes requested. Required for oauth and sso authentication type. Comma delimited."`
-	Audience       string `long:"audience" description:"Audience used for JWT self-signed token and STS. Required for jwt authentication type."`
-	Email          string `long:"email" description:"Email associated with SSO. Required for sso authentication type."`
-	QuotaProject   string `long:"quota_project" description:"Project override for quota and billing. Used for STS."`
-	Sts            bool   `long:"sts" description:"Perform STS token exchange."`
-	ServiceAccount string `long:"impersonate-service-account" description:"Exchange User acccess token for Service Account access token."`
+	Credentials         string `long:"credentials" description:"Credentials file containing OAuth Client Id or Service Account Key. Optional if environment variable GOOGLE_APPLICATION_CREDENTIALS is set."`
+	Scope               string `long:"scope" description:"List of OAuth scopes requested. Required for oauth and sso authentication type. Comma delimited."`
+	Audience            string `long:"audience" description:"Audience used for JWT self-signed token, ID token and STS. Required for jwt and idtoken authentication types."`
+	Email               string `long:"email" description:"Email associated with SSO. Required for sso authentication type."`
+	QuotaProject        string `long:"quota_project" description:"Project override for quota and billing. Used for STS."`
+	Sts                 bool   `long:"sts" description:"Perform STS token exchange."`
+	ServiceAccount      string `long:"impersonate-service-account" description:"Exchange User acccess token for Service Account access token. For jwt authentication type, sign the JWT with IAM as the Service Account instead."`
+	ServiceAccountAlias string `long:"service-account" description:"Same as --impersonate-service-account."`
+	Delegates           string `long:"delegates" description:"Chain of Service Accounts through which the Service Account is impersonated. Each must be allowed to impersonate the next. Comma delimited."`
+	// ImpersonateLifetime is sent to IAM as the lifetime of the impersonated access token.
+	ImpersonateLifetime time.Duration `long:"impersonate-lifetime" description:"Lifetime of the impersonated Service Account access token, up to 12h if allowed by the organization policy. Defaults to 1h."`
+	IamEndpoint         string        `long:"iam-endpoint" description:"IAM Service Account Credentials endpoint used by --impersonate-service-account. Defaults to https://iamcredentials.googleapis.com."`
+
+	// Downscoping parameters
+	AccessBoundary      string   `long:"access-boundary" description:"JSON file containing the Credential Access Boundary the access token is downscoped to."`
+	AccessBoundaryRules []string `long:"access-boundary-rule" description:"Rule of the Credential Access Boundary, in the form RESOURCE;PERMISSION[,PERMISSION...][;CONDITION]. Can be repeated."`
+	StsEndpoint         string   `long:"sts-endpoint" description:"STS token endpoint used for downscoping and CI OIDC federation. Defaults to https://sts.googleapis.com/v1/token."`
+
+	// Keyless federation parameters
+	CIOIDC                   string `long:"ci-oidc" choice:"github" choice:"gitlab" description:"Exchange the OIDC token of the CI job for a federated access token. Requires --workload-identity-provider."`
+	WorkloadIdentityProvider string `long:"workload-identity-provider" description:"Full resource name of the Workload Identity Provider trusting the CI job, such as projects/123/locations/global/workloadIdentityPools/my-pool/providers/my-provider."`
+
+	// API key parameters
+	APIKey     string `long:"api-key" description:"Google API key. Required for apikey authentication type, unless --api-key-file is set."`
+	APIKeyFile string `long:"api-key-file" description:"File containing the Google API key. Reads the key from stdin if set to -."`
+
+	// Generic provider parameters. Flags override the values of the provider file.
+	ProviderFile string `long:"provider-file" description:"JSON file configuring a generic OAuth 2.0 provider, such as Okta or Keycloak. Used for provider authentication type."`
+	Issuer       string `long:"issuer" description:"OpenID Connect issuer of the provider. Endpoints that are not set are discovered from its discovery document. For jwt authentication type, the iss claim of the JWT."`
+	ClientID     string `long:"client-id" description:"Client ID registered with the provider."`
+	ClientSecret string `long:"client-secret" description:"Client secret registered with the provider. Required for the client credentials grant."`
+	AuthURL      string `long:"auth-url" description:"Authorization endpoint of the provider. Required for the authorization code flow."`
+	TokenURL     string `long:"token-url" description:"Token endpoint of the provider."`
+	RedirectURI  string `long:"redirect-uri" description:"Redirect URI of the authorization code flow. Defaults to http://localhost, served on a dynamic port."`
+	GrantType    string `long:"grant-type" choice:"client_credentials" choice:"authorization_code" description:"Grant type used with the provider. Defaults to authorization_code if an auth URL is set, and to client_credentials otherwise."`
+
+	// Self-signed JWT parameters. The issuer is given by --issuer.
+	Claims     []string      `long:"claim" description:"Additional claim of the JWT, in the form KEY=VALUE. Values are parsed as JSON if possible, and used as strings otherwise. Can be repeated."`
+	ClaimsFile string        `long:"claims-file" description:"JSON file containing additional claims of the JWT. Overridden by --claim."`
+	Subject    string        `long:"subject" description:"The sub claim of the JWT. Defaults to the Service Account email."`
+	Lifetime   time.Duration `long:"lifetime" description:"Lifetime of the JWT. Defaults to 1h."`
+	SigningKey string        `long:"signing-key" description:"PEM encoded RSA or EC private key, JWK or JWKS used to sign the JWT instead of the Service Account key."`
+	Algorithm  string        `long:"alg" choice:"RS256" choice:"RS384" choice:"RS512" choice:"PS256" choice:"ES256" choice:"ES384" description:"Algorithm used to sign the JWT. Defaults to the alg of the JWK, or to RS256, ES256 or ES384 depending on the key."`
+	KeyID      string        `long:"kid" description:"The kid header of the JWT. Also selects the key of a JWKS given by --signing-key."`
 
 	// Client parameters
 	SsoCli string `long:"ssocli" description:"Path to SSO CLI. Optional."`
 
+	// AllowExecutables is required for external_account credentials with an executable credential source.
+	AllowExecutables bool `long:"allow-executables" description:"Allow external_account credentials to run their executable to obtain subject tokens. Same as setting GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES=1."`
+
 	// Cache is declared as a pointer type and can be one of nil, empty (""), or a custom file path.
-	Cache *string `long:"cache" description:"Path to the credential cache file. Disables caching if set to empty. Defaults to ~/.oauth2l."`
+	Cache *string `long:"cache" description:"Path to the credential cache file, or a cache store selector: file:PATH, dir:PATH or memory:. Disables caching if set to empty. Defaults to ~/.oauth2l."`
 
-	// Refresh is used for 3LO flow. When used in conjunction with caching, the user can avoid re-authorizing.
-	Refresh bool `long:"refresh" description:"If the cached access token is expired, attempt to refresh it using refreshToken."`
+	// CacheKeyFile enables encryption of the cache. Alternatively, the key can be set via OAUTH2L_CACHE_KEY.
+	CacheKeyFile string `long:"cache-key-file" description:"Path to a file containing the key used to encrypt the credential cache. Overrides environment variable OAUTH2L_CACHE_KEY."`
 
-	// Consent page parameters.
-	DisableAutoOpenConsentPage         bool   `long:"disableAutoOpenConsentPage" description:"Disables the ability to open the consent page automatically."`
-	ConsentPageInteractionTimeout      int    `long:"consentPageInteractionTimeout" description:"Maximum wait time for user to interact with consent page." default:"2"`
-	ConsentPageInteractionTimeoutUnits string `long:"consentPageInteractionTimeoutUnits" choice:"seconds" choice:"minutes" description:"Consent page timeout units." default:"minutes"`
+	// NoPrompt is used by scripts that must not block on user interaction.
+	NoPrompt bool `long:"no-prompt" description:"Fail instead of prompting for authorization if no token can be obtained from the cache or a refresh token."`
+
+	// MinValidity avoids returning cached tokens that expire while they are in use.
+	MinValidity time.Duration `long:"min-validity" description:"Minimum remaining validity of cached tokens. Tokens expiring sooner are refreshed or fetched again." default:"1m"`
+
+	// CacheTTL limits caching of tokens without expiry, such as SSO and STS tokens.
+	CacheTTL time.Duration `long:"cache-ttl" description:"Maximum time tokens without expiry are served from the cache. Set to 0 to cache them indefinitely." default:"1h"`
+
+	consentPageOptions
 
 	// Deprecated flags kept for backwards compatibility. Hidden from help page.
 	Json      string `long:"json" description:"Deprecated. Same as --credentials." hidden:"true"`
 	Jwt       bool   `long:"jwt" description:"Deprecated. Same as --type jwt." hidden:"true"`
 	Sso       bool   `long:"sso" description:"Deprecated. Same as --type sso." hidden:"true"`
+	Refresh   bool   `long:"refresh" description:"Deprecated. Expired tokens are refreshed by default." hidden:"true"`
 	OldFormat string `long:"credentials_format" choice:"bare" choice:"header" choice:"json" choice:"json_compact" choice:"pretty" description:"Deprecated. Same as --output_format" hidden:"true"`
 }
 
+// Consent page options of commands that may authorize the user.
+type consentPageOptions struct {
+	DisableAutoOpenConsentPage         bool   `long:"disableAutoOpenConsentPage" description:"Disables the ability to open the consent page automatically."`
+	ConsentPageInteractionTimeout      int    `long:"consentPageInteractionTimeout" description:"Maximum wait time for user to interact with consent page." default:"2"`
+	ConsentPageInteractionTimeoutUnits string `long:"consentPageInteractionTimeoutUnits" choice:"seconds" choice:"minutes" description:"Consent page timeout units." default:"minutes"`
+}
+
 // Additional options for "fetch" command.
 type fetchOptions struct {
 	commonFetchOptions
@@ -111,17 +175,113 @@ type curlOptions struct {
 	commonFetchOptions
 	CurlCli string `long:"curlcli" description:"Path to Curl CLI. Optional."`
 	Url     string `long:"url" description:"URL endpoint for the curl request." required:"true"`
+	// APIKeyParam is used for APIs that do not accept the X-Goog-Api-Key header.
+	APIKeyParam bool `long:"api-key-param" description:"Send the API key as key query parameter instead of X-Goog-Api-Key header. Only used for apikey authentication type."`
+}
+
+// Additional options for "revoke" command.
+type revokeOptions struct {
+	commonFetchOptions
+	Token string `long:"token" description:"Access or refresh token to revoke. Revokes the cached token for the given arguments if not set."`
+}
+
+// Options for "exchange" command.
+type exchangeOptions struct {
+	Endpoint           string   `long:"endpoint" description:"Token endpoint of the Security Token Service." default:"https://sts.googleapis.com/v1/token"`
+	SubjectTokenFile   string   `long:"subject-token-file" description:"File containing the subject token. Reads the token from stdin if set to - or not set."`
+	SubjectTokenType   string   `long:"subject-token-type" description:"Type of the subject token, either a URN or one of access_token, refresh_token, id_token, jwt, saml1 and saml2." default:"access_token"`
+	ActorTokenFile     string   `long:"actor-token-file" description:"File containing the actor token. Reads the token from stdin if set to -. Optional."`
+	ActorTokenType     string   `long:"actor-token-type" description:"Type of the actor token, either a URN or one of access_token, refresh_token, id_token, jwt, saml1 and saml2." default:"access_token"`
+	Resource           []string `long:"resource" description:"URI of the target service where the token is used. Can be repeated."`
+	Audience           []string `long:"audience" description:"Logical name of the target service where the token is used. Can be repeated."`
+	RequestedTokenType string   `long:"requested-token-type" description:"Type of the requested token, either a URN or one of access_token, refresh_token, id_token, jwt, saml1 and saml2." default:"access_token"`
+	Scope              string   `long:"scope" description:"List of scopes requested. Scopes are sent as given, without adding the Google OAuth scope prefix. Comma delimited."`
+	Format             string   `long:"output_format" choice:"bare" choice:"header" choice:"json" choice:"json_compact" description:"Token's output format." default:"bare"`
+
+	// Cache is declared as a pointer type and can be one of nil, empty (""), or a custom file path.
+	Cache        *string       `long:"cache" description:"Path to the credential cache file, or a cache store selector: file:PATH, dir:PATH or memory:. Disables caching if set to empty. Defaults to ~/.oauth2l."`
+	CacheKeyFile string        `long:"cache-key-file" description:"Path to a file containing the key used to encrypt the credential cache. Overrides environment variable OAUTH2L_CACHE_KEY."`
+	MinValidity  time.Duration `long:"min-validity" description:"Minimum remaining validity of cached tokens. Tokens expiring sooner are exchanged again." default:"1m"`
+	CacheTTL     time.Duration `long:"cache-ttl" description:"Maximum time tokens without expiry are served from the cache. Set to 0 to cache them indefinitely." default:"1h"`
+}
+
+// Options for "sign" command.
+type signOptions struct {
+	Payload        string `long:"payload" description:"File containing the payload to sign. Reads the payload from stdin if set to - or not set."`
+	JWT            bool   `long:"jwt" description:"Sign the payload, a JSON object of claims, as JWT."`
+	Credentials    string `long:"credentials" description:"Service Account key signing the payload, or credentials impersonating the Service Account. Optional if environment variable GOOGLE_APPLICATION_CREDENTIALS is set."`
+	ServiceAccount string `long:"impersonate-service-account" description:"Sign the payload with IAM signBlob or signJwt as the given Service Account instead of signing it locally."`
+	Delegates      string `long:"delegates" description:"Chain of Service Accounts through which the Service Account is impersonated. Each must be allowed to impersonate the next. Comma delimited."`
+	IamEndpoint    string `long:"iam-endpoint" description:"IAM Service Account Credentials endpoint used by --impersonate-service-account. Defaults to https://iamcredentials.googleapis.com."`
+	SigningKey     string `long:"signing-key" description:"PEM encoded RSA or EC private key, JWK or JWKS signing the payload locally instead of the Service Account key."`
+	Algorithm      string `long:"alg" choice:"RS256" choice:"RS384" choice:"RS512" choice:"PS256" choice:"ES256" choice:"ES384" description:"Algorithm used to sign the payload locally. Defaults to the alg of the JWK, or to RS256, ES256 or ES384 depending on the key."`
+	KeyID          string `long:"kid" description:"The kid header of a JWT signed locally. Also selects the key of a JWKS given by --signing-key."`
+	Format         string `long:"output_format" choice:"bare" choice:"json" description:"Signature's output format. The json format includes the key ID." default:"bare"`
+
+	// Cache is declared as a pointer type and can be one of nil, empty (""), or a custom file path.
+	Cache        *string `long:"cache" description:"Path to the credential cache file, or a cache store selector: file:PATH, dir:PATH or memory:. Disables caching if set to empty. Defaults to ~/.oauth2l."`
+	CacheKeyFile string  `long:"cache-key-file" description:"Path to a file containing the key used to encrypt the credential cache. Overrides environment variable OAUTH2L_CACHE_KEY."`
+	NoPrompt     bool    `long:"no-prompt" description:"Fail instead of prompting for authorization if no token can be obtained from the cache or a refresh token."`
+
+	consentPageOptions
 }
 
 // Options for "info" and "test" commands.
 type infoOptions struct {
 	Token string `long:"token" description:"OAuth access token to analyze."`
+	// Issuer is used for tokens of generic providers, which Google's token info endpoint does not know.
+	Issuer string `long:"issuer" description:"OpenID Connect issuer of the token. Analyzes the token with the userinfo endpoint of the issuer instead of Google's token info endpoint."`
 }
 
 // Options for "reset" command.
 type resetOptions struct {
 	// Cache is declared as a pointer type and can be one of nil or a custom file path.
-	Cache *string `long:"cache" description:"Path to the credential cache file to remove. Defaults to ~/.oauth2l."`
+	Cache        *string `long:"cache" description:"Path to the credential cache file, or a cache store selector, to remove. Defaults to ~/.oauth2l."`
+	CacheKeyFile string  `long:"cache-key-file" description:"Path to a file containing the key used to encrypt the credential cache. Overrides environment variable OAUTH2L_CACHE_KEY."`
+	Revoke       bool    `long:"revoke" description:"Revoke all cached tokens at the authorization server before resetting the cache."`
+}
+
+// Options for "cache" command.
+type cacheOptions struct {
+	List   cacheListOptions   `command:"list" description:"List cached tokens without revealing them."`
+	Show   cacheShowOptions   `command:"show" description:"Show the cached token with the given ID without revealing it."`
+	Delete cacheDeleteOptions `command:"delete" description:"Delete cached tokens matching the filters."`
+}
+
+// Common options for "cache" subcommands.
+type cacheCommonOptions struct {
+	// Cache is declared as a pointer type and can be one of nil or a custom file path.
+	Cache        *string `long:"cache" description:"Path to the credential cache file, or a cache store selector: file:PATH or dir:PATH. Defaults to ~/.oauth2l."`
+	CacheKeyFile string  `long:"cache-key-file" description:"Path to a file containing the key used to encrypt the credential cache. Overrides environment variable OAUTH2L_CACHE_KEY."`
+}
+
+// Filters for "cache list" and "cache delete" commands.
+type cacheFilterOptions struct {
+	Credentials    string `long:"credentials" description:"Select tokens fetched with the given credentials file."`
+	Scope          string `long:"scope" description:"Select tokens authorized for all of the given scopes. Comma delimited."`
+	Audience       string `long:"audience" description:"Select tokens fetched for the given audience."`
+	Email          string `long:"email" description:"Select tokens fetched for the given email."`
+	ServiceAccount string `long:"impersonate-service-account" description:"Select tokens of the given impersonated Service Account."`
+	Expired        bool   `long:"expired" description:"Select expired tokens only."`
+}
+
+// Options for "cache list" command.
+type cacheListOptions struct {
+	cacheCommonOptions
+	cacheFilterOptions
+}
+
+// Options for "cache show" command.
+type cacheShowOptions struct {
+	cacheCommonOptions
+	ID string `long:"id" description:"ID of the cached token, as printed by \"cache list\". Prefixes are accepted."`
+}
+
+// Options for "cache delete" command.
+type cacheDeleteOptions struct {
+	cacheCommonOptions
+	cacheFilterOptions
+	All bool `long:"all" description:"Delete all cached tokens. Required if no filter is specified."`
 }
 
 // Options for "web" command
@@ -153,10 +313,283 @@ func parseScopes(scopes []string) string {
 	return strings.Join(scopes, " ")
 }
 
-// Overrides default cache location if configured.
-func setCacheLocation(cache *string) {
+// Splits the comma delimited delegates.
+func parseDelegates(delegates string) []string {
+	var parsed []string
+	for _, delegate := range strings.Split(delegates, ",") {
+		if delegate = strings.TrimSpace(delegate); delegate != "" {
+			parsed = append(parsed, delegate)
+		}
+	}
+	return parsed
+}
+
+// Builds the access boundary from the boundary file and inline rules.
+// Returns nil if neither is given.
+func getAccessBoundary(commonOpts commonFetchOptions) (*util.AccessBoundary, error) {
+	boundary := &util.AccessBoundary{}
+	if commonOpts.AccessBoundary != "" {
+		data, err := ioutil.ReadFile(commonOpts.AccessBoundary)
+		if err != nil {
+			return nil, err
+		}
+		boundary, err = util.ParseAccessBoundary(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range commonOpts.AccessBoundaryRules {
+		parsed, err := util.ParseAccessBoundaryRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		boundary.AccessBoundaryRules = append(boundary.AccessBoundaryRules, parsed)
+	}
+	if len(boundary.AccessBoundaryRules) == 0 {
+		return nil, nil
+	}
+	return boundary, nil
+}
+
+// Expands the short names of RFC 8693 token types to their URNs.
+func parseTokenType(tokenType string) string {
+	switch tokenType {
+	case "access_token":
+		return util.TokenTypeAccessToken
+	case "refresh_token":
+		return util.TokenTypeRefreshToken
+	case "id_token":
+		return util.TokenTypeIDToken
+	case "jwt":
+		return util.TokenTypeJWT
+	case "saml1":
+		return util.TokenTypeSAML1
+	case "saml2":
+		return util.TokenTypeSAML2
+	}
+	return tokenType
+}
+
+// Reads a token from the given file, or from stdin if file is empty or "-".
+func readToken(file string) (string, error) {
+	var data []byte
+	var err error
+	if file == "" || file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// Returns the API key given by --api-key or read from --api-key-file.
+func getAPIKey(commonOpts commonFetchOptions) (string, error) {
+	if commonOpts.APIKey != "" {
+		return commonOpts.APIKey, nil
+	}
+	if commonOpts.APIKeyFile != "" {
+		return readToken(commonOpts.APIKeyFile)
+	}
+	return "", nil
+}
+
+// Builds the generic provider configuration from the provider file and
+// flags. Flags take precedence over the provider file.
+func getProviderConfig(commonOpts commonFetchOptions) (*util.ProviderConfig, error) {
+	provider := &util.ProviderConfig{}
+	if commonOpts.ProviderFile != "" {
+		data, err := ioutil.ReadFile(commonOpts.ProviderFile)
+		if err != nil {
+			return nil, err
+		}
+		if provider, err = util.ParseProviderConfig(data); err != nil {
+			return nil, err
+		}
+	}
+	overrides := []struct {
+		value  string
+		target *string
+	}{
+		{commonOpts.Issuer, &provider.Issuer},
+		{commonOpts.ClientID, &provider.ClientID},
+		{commonOpts.ClientSecret, &provider.ClientSecret},
+		{commonOpts.AuthURL, &provider.AuthURL},
+		{commonOpts.TokenURL, &provider.TokenURL},
+		{commonOpts.RedirectURI, &provider.RedirectURI},
+		{commonOpts.GrantType, &provider.GrantType},
+		{commonOpts.Audience, &provider.Audience},
+	}
+	for _, override := range overrides {
+		if override.value != "" {
+			*override.target = override.value
+		}
+	}
+	return provider, nil
+}
+
+// Builds the custom claims and signing key of self-signed JWTs from the
+// claims file, inline claims and signing key file. Returns nil if neither
+// is customized.
+func getJWTSettings(commonOpts commonFetchOptions) (*util.JWTSettings, error) {
+	claims := map[string]interface{}{}
+	if commonOpts.ClaimsFile != "" {
+		data, err := ioutil.ReadFile(commonOpts.ClaimsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return nil, fmt.Errorf("Failed to parse claims file: %v", err)
+		}
+	}
+	for _, claim := range commonOpts.Claims {
+		parts := strings.SplitN(claim, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid claim %q, expected KEY=VALUE", claim)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[1]), &value); err != nil {
+			value = parts[1]
+		}
+		claims[parts[0]] = value
+	}
+	if len(claims) == 0 {
+		claims = nil
+	}
+	jwt := &util.JWTSettings{
+		Issuer:    commonOpts.Issuer,
+		Subject:   commonOpts.Subject,
+		Lifetime:  commonOpts.Lifetime,
+		Claims:    claims,
+		Algorithm: commonOpts.Algorithm,
+		KeyID:     commonOpts.KeyID,
+	}
+	signingKey, err := readSigningKey(commonOpts.SigningKey, commonOpts.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	jwt.SigningKey = signingKey
+	if jwt.Issuer == "" && jwt.Subject == "" && jwt.Lifetime == 0 && jwt.Claims == nil &&
+		jwt.SigningKey == nil && jwt.Algorithm == "" && jwt.KeyID == "" {
+		return nil, nil
+	}
+	return jwt, nil
+}
+
+// Reads the signing key from the given PEM, JWK or JWKS file. Returns nil
+// if no file is given.
+func readSigningKey(file string, keyID string) (*util.SigningKey, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return util.ParseSigningKey(data, keyID)
+}
+
+// Reads the payload to sign from the given file, or from stdin if the file
+// is - or not set. Unlike tokens, payloads are signed as is.
+func readPayload(file string) ([]byte, error) {
+	if file == "" || file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// Returns the settings identifying the revocation endpoint for a token
+// obtained with the given credentials or generic provider.
+func getRevocationSettings(commonOpts commonFetchOptions, authType string, credentials string) (*util.Settings, error) {
+	if authType == util.AuthTypeProvider {
+		provider, err := getProviderConfig(commonOpts)
+		if err != nil {
+			return nil, err
+		}
+		if err := provider.ResolveIssuer(); err != nil {
+			return nil, err
+		}
+		return &util.Settings{AuthType: util.AuthTypeProvider, Provider: provider}, nil
+	}
+	json, err := readJSON(credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &util.Settings{AuthType: authType, CredentialsJSON: json}, nil
+}
+
+// Starts the localhost server receiving the authorization code sent to the
+// given redirect URI. Returns the address the server listens on, which has
+// a dynamic port if the redirect URI has none.
+func startAuthCodeServer(consentOpts consentPageOptions, redirectUri string) (util.AuthorizationCodeServer,
+	util.ConsentPageSettings, string, error) {
+	var consentPageSettings util.ConsentPageSettings
+	interactionTimeout, err := getTimeDuration(consentOpts.ConsentPageInteractionTimeout, consentOpts.ConsentPageInteractionTimeoutUnits)
+	if err != nil {
+		return nil, consentPageSettings, "", fmt.Errorf("Failed to create time.Duration: %v", err)
+	}
+	consentPageSettings = util.ConsentPageSettings{
+		DisableAutoOpenConsentPage: consentOpts.DisableAutoOpenConsentPage,
+		InteractionTimeout:         interactionTimeout,
+	}
+	authCodeServer := &util.AuthorizationCodeLocalhost{
+		ConsentPageSettings: consentPageSettings,
+		AuthCodeReqStatus: util.AuthorizationCodeStatus{
+			Status: util.WAITING, Details: "Authorization code not yet set."},
+	}
+	adr, err := authCodeServer.ListenAndServe(redirectUri)
+	if err != nil {
+		return nil, consentPageSettings, "", err
+	}
+	return authCodeServer, consentPageSettings, adr, nil
+}
+
+// Starts the localhost server receiving the authorization code if the
+// credentials are OAuth client secrets with a localhost redirect URI. If a
+// dynamic port is used, the redirect URI of the returned credentials is
+// replaced by the address of the server. Returns a nil server otherwise.
+func startLoopbackAuthCodeServer(consentOpts consentPageOptions, json string) (string,
+	util.AuthorizationCodeServer, util.ConsentPageSettings, error) {
+	var consentPageSettings util.ConsentPageSettings
+	redirectUri, err := util.GetFirstRedirectURI(json)
+	// 3LO Loopback case
+	if err != nil || !strings.Contains(redirectUri, "localhost") {
+		return json, nil, consentPageSettings, nil
+	}
+	authCodeServer, consentPageSettings, adr, err := startAuthCodeServer(consentOpts, redirectUri)
+	if err != nil {
+		return json, nil, consentPageSettings, err
+	}
+
+	// If a different dynamic redirect uri was created, replace the redirect uri in file.
+	// this happens if the original redirect does not have a port for the localhost.
+	redirectUri = fmt.Sprintf("\"%s\"", redirectUri)
+	adr = fmt.Sprintf("\"%s\"", adr)
+	return strings.Replace(json, redirectUri, adr, -1), authCodeServer, consentPageSettings, nil
+}
+
+// Overrides default cache store if configured.
+func setCacheStore(cache *string) error {
 	if cache != nil {
-		util.CacheLocation = *cache
+		store, err := util.ParseCacheStore(*cache)
+		if err != nil {
+			return err
+		}
+		util.Cache = store
+	}
+	return nil
+}
+
+// Overrides IAM Service Account Credentials endpoint if configured.
+func setIamEndpoint(endpoint string) {
+	if endpoint != "" {
+		util.IamEndpoint = endpoint
+	}
+}
+
+// Overrides cache encryption key file if configured.
+func setCacheKeyFile(file string) {
+	if file != "" {
+		util.CacheKeyFile = file
 	}
 }
 
@@ -177,6 +610,8 @@ func getCommonFetchOptions(cmdOpts commandOptions, cmd string) commonFetchOption
 		commonOpts = cmdOpts.Header.commonFetchOptions
 	case "curl":
 		commonOpts = cmdOpts.Curl.commonFetchOptions
+	case "revoke":
+		commonOpts = cmdOpts.Revoke.commonFetchOptions
 	}
 	return commonOpts
 }
@@ -234,6 +669,25 @@ func getScopesWithFallback(scope string, remainingArgs ...string) []string {
 	return scopes
 }
 
+// Builds the cache filter from the command-line filters.
+func getCacheFilter(filterOpts cacheFilterOptions) (*util.CacheFilter, error) {
+	json, err := readJSON(filterOpts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	filter := &util.CacheFilter{
+		CredentialsJSON: json,
+		Audience:        filterOpts.Audience,
+		Email:           filterOpts.Email,
+		ServiceAccount:  filterOpts.ServiceAccount,
+		Expired:         filterOpts.Expired,
+	}
+	if filterOpts.Scope != "" {
+		filter.Scope = parseScopes(getScopesWithFallback(filterOpts.Scope))
+	}
+	return filter, nil
+}
+
 // Extracts the info options based on chosen command.
 func getInfoOptions(cmdOpts commandOptions, cmd string) infoOptions {
 	var infoOpts infoOptions
@@ -259,11 +713,12 @@ func main() {
 	// Get the name of the selected command
 	cmd := parser.Active.Name
 
-	// Tasks that fetch the access token.
-	fetchTasks := map[string]func(*util.Settings, *util.TaskSettings){
+	// Tasks that fetch the access token. The command fails if they return an error.
+	fetchTasks := map[string]func(*util.Settings, *util.TaskSettings) error{
 		"fetch":  util.Fetch,
 		"header": util.Header,
 		"curl":   util.Curl,
+		"revoke": util.Revoke,
 	}
 
 	// Tasks that verify the existing token.
@@ -272,6 +727,12 @@ func main() {
 		"test": util.Test,
 	}
 
+	// Tasks that verify the existing token with an OpenID Connect issuer.
+	issuerTasks := map[string](func(string, string) int){
+		"info": util.IssuerInfo,
+		"test": util.IssuerTest,
+	}
+
 	if task, ok := fetchTasks[cmd]; ok {
 		commonOpts := getCommonFetchOptions(opts, cmd)
 		authType := getAuthTypeWithFallback(commonOpts)
@@ -281,27 +742,172 @@ func main() {
 		quotaProject := commonOpts.QuotaProject
 		sts := commonOpts.Sts
 		serviceAccount := commonOpts.ServiceAccount
+		if serviceAccount == "" {
+			serviceAccount = commonOpts.ServiceAccountAlias
+		}
+		delegates := parseDelegates(commonOpts.Delegates)
+		lifetime := commonOpts.ImpersonateLifetime
 		email := commonOpts.Email
 		ssocli := commonOpts.SsoCli
-		setCacheLocation(commonOpts.Cache)
-		refresh := commonOpts.Refresh
+		if serviceAccount == "" && (len(delegates) > 0 || lifetime != 0) {
+			fmt.Println("--delegates and --impersonate-lifetime require --impersonate-service-account")
+			os.Exit(1)
+		}
+		if lifetime < 0 {
+			fmt.Println("--impersonate-lifetime must not be negative")
+			os.Exit(1)
+		}
+		if lifetime != 0 && authType == util.AuthTypeIDToken {
+			fmt.Println("--impersonate-lifetime cannot be used for ID tokens. They are valid for 1h.")
+			os.Exit(1)
+		}
+		accessBoundary, err := getAccessBoundary(commonOpts)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if accessBoundary != nil && (authType == util.AuthTypeJWT || authType == util.AuthTypeIDToken) {
+			fmt.Println("Access boundaries are not supported for authentication type " + authType)
+			return
+		}
+		if err := setCacheStore(commonOpts.Cache); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		setCacheKeyFile(commonOpts.CacheKeyFile)
+		setIamEndpoint(commonOpts.IamEndpoint)
+		if commonOpts.AllowExecutables {
+			util.AllowExecutables()
+		}
+		// Revoking a given token only requires the revocation endpoint.
+		if cmd == "revoke" && opts.Revoke.Token != "" {
+			settings, err := getRevocationSettings(commonOpts, authType, credentials)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			if err := util.RevokeToken(settings, opts.Revoke.Token); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+		// Revoking a cached token only looks up the cache, so the server
+		// receiving authorization codes is not needed.
+		authorize := cmd != "revoke"
+
 		format := getOutputFormatWithFallback(opts.Fetch)
 		curlcli := opts.Curl.CurlCli
 		url := opts.Curl.Url
+		apiKeyParam := opts.Curl.APIKeyParam
 
 		taskSettings := &util.TaskSettings{
-			AuthType:  authType,
-			Format:    format,
-			CurlCli:   curlcli,
-			Url:       url,
-			ExtraArgs: remainingArgs,
-			SsoCli:    ssocli,
-			Refresh:   refresh,
+			AuthType:    authType,
+			Format:      format,
+			CurlCli:     curlcli,
+			Url:         url,
+			ExtraArgs:   remainingArgs,
+			APIKeyParam: apiKeyParam,
+			SsoCli:      ssocli,
+			NoPrompt:    commonOpts.NoPrompt,
+			MinValidity: commonOpts.MinValidity,
+			CacheTTL:    commonOpts.CacheTTL,
 		}
 
 		// Configure GUAC settings based on authType.
 		var settings *util.Settings
-		if authType == util.AuthTypeJWT {
+		if commonOpts.CIOIDC != "" {
+			if commonOpts.WorkloadIdentityProvider == "" {
+				fmt.Println("Missing --workload-identity-provider argument for CI OIDC")
+				return
+			}
+			scopes := getScopesWithFallback(scope, remainingArgs...)
+			if len(scopes) < 1 {
+				scopes = []string{"cloud-platform"}
+			}
+
+			// CI OIDC federation does not use CredentialsJSON
+			settings = &util.Settings{
+				AuthType:                 util.AuthTypeCIOIDC,
+				CIProvider:               commonOpts.CIOIDC,
+				WorkloadIdentityProvider: commonOpts.WorkloadIdentityProvider,
+				Scope:                    parseScopes(scopes),
+				ServiceAccount:           serviceAccount,
+				Delegates:                delegates,
+				ServiceAccountLifetime:   lifetime,
+			}
+		} else if authType == util.AuthTypeAPIKey {
+			apiKey, err := getAPIKey(commonOpts)
+			if err != nil {
+				fmt.Println("Failed to read API key")
+				fmt.Println(err.Error())
+				return
+			}
+			if apiKey == "" {
+				fmt.Println("Missing --api-key or --api-key-file argument for API key")
+				return
+			}
+			if sts || serviceAccount != "" || accessBoundary != nil {
+				fmt.Println("API keys cannot be used with --sts, --impersonate-service-account or access boundaries")
+				return
+			}
+
+			// API keys are used as is and never cached
+			settings = &util.Settings{
+				AuthType: util.AuthTypeAPIKey,
+				APIKey:   apiKey,
+			}
+		} else if authType == util.AuthTypeProvider {
+			provider, err := getProviderConfig(commonOpts)
+			if err != nil {
+				fmt.Println("Failed to open file: " + commonOpts.ProviderFile)
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			if err := provider.ResolveIssuer(); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			if err := provider.Validate(); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			// Scopes are sent as given, without the Google OAuth scope prefix.
+			scopes := getScopesWithFallback(scope, remainingArgs...)
+			if len(scopes) < 1 {
+				scopes = provider.Scopes
+			}
+
+			var authCodeServer util.AuthorizationCodeServer = nil
+			var consentPageSettings util.ConsentPageSettings
+			if provider.GetGrantType() == util.GrantTypeAuthorizationCode {
+				redirectUri := provider.RedirectURI
+				if redirectUri == "" {
+					redirectUri = util.DefaultProviderRedirectURI
+				}
+				if authorize && strings.Contains(redirectUri, "localhost") {
+					var adr string
+					authCodeServer, consentPageSettings, adr, err = startAuthCodeServer(commonOpts.consentPageOptions, redirectUri)
+					if err != nil {
+						fmt.Println(err)
+						return
+					}
+					// Close localhost server's port on exit
+					defer authCodeServer.Close()
+					provider.RedirectURI = adr
+				}
+			}
+
+			// Generic provider does not use CredentialsJSON
+			settings = &util.Settings{
+				AuthType:    util.AuthTypeProvider,
+				Provider:    provider,
+				Scope:       strings.Join(scopes, " "),
+				AuthHandler: util.Get3LOAuthorizationHandler(defaultState, consentPageSettings, &authCodeServer),
+				State:       defaultState,
+			}
+		} else if authType == util.AuthTypeJWT {
 			json, err := readJSON(credentials)
 			if err != nil {
 				fmt.Println("Failed to open file: " + credentials)
@@ -316,17 +922,54 @@ func main() {
 				}
 			}
 
+			jwt, err := getJWTSettings(commonOpts)
+			if err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+
 			scopes := getScopesWithFallback(scope, remainingArgs...)
-			if audience == "" && len(scopes) < 1 {
+			if audience == "" && len(scopes) < 1 && (jwt == nil || jwt.Claims["aud"] == nil) {
 				fmt.Println("Neither audience nor scope argument is provided for JWT")
 				return
 			}
 
+			// With impersonation, the JWT is signed by IAM on behalf of the
+			// base credentials, which may require user consent.
+			var authCodeServer util.AuthorizationCodeServer = nil
+			var consentPageSettings util.ConsentPageSettings
+			if serviceAccount != "" {
+				if jwt != nil && (jwt.SigningKey != nil || jwt.Algorithm != "" || jwt.KeyID != "") {
+					fmt.Println("--signing-key, --alg and --kid cannot be used with --impersonate-service-account")
+					os.Exit(1)
+				}
+				if commonOpts.ImpersonateLifetime != 0 {
+					fmt.Println("--impersonate-lifetime cannot be used for JWT. Use --lifetime instead.")
+					os.Exit(1)
+				}
+			}
+			if authorize && serviceAccount != "" {
+				json, authCodeServer, consentPageSettings, err = startLoopbackAuthCodeServer(commonOpts.consentPageOptions, json)
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				if authCodeServer != nil {
+					// Close localhost server's port on exit
+					defer authCodeServer.Close()
+				}
+			}
+
 			settings = &util.Settings{
 				AuthType:        util.AuthTypeJWT,
 				CredentialsJSON: json,
 				Audience:        audience,
 				Scope:           parseScopes(scopes),
+				JWT:             jwt,
+				AuthHandler:     util.Get3LOAuthorizationHandler(defaultState, consentPageSettings, &authCodeServer),
+				State:           defaultState,
+				ServiceAccount:  serviceAccount,
+				Delegates:       delegates,
 			}
 		} else if authType == util.AuthTypeSSO {
 			// Fallback to reading email from first remaining arg
@@ -349,18 +992,40 @@ func main() {
 
 			// SSO flow does not use CredentialsJSON
 			settings = &util.Settings{
-				Email:          email,
-				Scope:          parseScopes(scopes),
-				Audience:       audience,
-				QuotaProject:   quotaProject,
-				Sts:            sts,
-				ServiceAccount: serviceAccount,
+				AuthType:               util.AuthTypeSSO,
+				Email:                  email,
+				Scope:                  parseScopes(scopes),
+				Audience:               audience,
+				QuotaProject:           quotaProject,
+				Sts:                    sts,
+				ServiceAccount:         serviceAccount,
+				Delegates:              delegates,
+				ServiceAccountLifetime: lifetime,
 			}
-		} else {
-			// OAuth flow
+		} else if authType == util.AuthTypeMetadata {
+			// Without scopes, the token carries the scopes of the instance.
+			// With an audience but neither scopes nor STS, an ID token is fetched.
+			scopes := getScopesWithFallback(scope, remainingArgs...)
+			if lifetime != 0 && len(scopes) < 1 && audience != "" && !sts {
+				fmt.Println("--impersonate-lifetime cannot be used for ID tokens. They are valid for 1h.")
+				os.Exit(1)
+			}
+
+			// Metadata server does not use CredentialsJSON
+			settings = &util.Settings{
+				AuthType:               util.AuthTypeMetadata,
+				Scope:                  parseScopes(scopes),
+				Audience:               audience,
+				QuotaProject:           quotaProject,
+				Sts:                    sts,
+				ServiceAccount:         serviceAccount,
+				Delegates:              delegates,
+				ServiceAccountLifetime: lifetime,
+			}
+		} else if authType == util.AuthTypeDevice {
 			scopes := getScopesWithFallback(scope, remainingArgs...)
 			if len(scopes) < 1 {
-				fmt.Println("Missing scope argument for OAuth 2.0")
+				fmt.Println("Missing scope argument for device flow")
 				return
 			}
 
@@ -370,60 +1035,219 @@ func main() {
 				fmt.Println(err.Error())
 				return
 			}
+			if json == "" {
+				fmt.Println("Missing credentials argument for device flow")
+				return
+			}
 
-			var authCodeServer util.AuthorizationCodeServer = nil
-			var consentPageSettings util.ConsentPageSettings
-			redirectUri, err := util.GetFirstRedirectURI(json)
-			// 3LO Loopback case
-			if err == nil && strings.Contains(redirectUri, "localhost") {
-				interactionTimeout, err := getTimeDuration(commonOpts.ConsentPageInteractionTimeout, commonOpts.ConsentPageInteractionTimeoutUnits)
-				if err != nil {
-					fmt.Println("Failed to create time.Duration: " + err.Error())
-					return
-				}
-				consentPageSettings = util.ConsentPageSettings{
-					DisableAutoOpenConsentPage: commonOpts.DisableAutoOpenConsentPage,
-					InteractionTimeout:         interactionTimeout,
+			settings = &util.Settings{
+				CredentialsJSON:        json,
+				Scope:                  parseScopes(scopes),
+				Audience:               audience,
+				QuotaProject:           quotaProject,
+				Sts:                    sts,
+				ServiceAccount:         serviceAccount,
+				Delegates:              delegates,
+				ServiceAccountLifetime: lifetime,
+				AuthType:               util.AuthTypeDevice,
+			}
+		} else {
+			// OAuth flow, or ID token flow which accepts the same credentials.
+			var scopes []string
+			if authType == util.AuthTypeIDToken {
+				// Fallback to reading audience from first remaining arg
+				if audience == "" {
+					if len(remainingArgs) > 0 {
+						audience = remainingArgs[0]
+					} else {
+						fmt.Println("Missing audience argument for ID token")
+						return
+					}
 				}
-				authCodeServer = &util.AuthorizationCodeLocalhost{
-					ConsentPageSettings: consentPageSettings,
-					AuthCodeReqStatus: util.AuthorizationCodeStatus{
-						Status: util.WAITING, Details: "Authorization code not yet set."},
+			} else {
+				scopes = getScopesWithFallback(scope, remainingArgs...)
+				if len(scopes) < 1 {
+					fmt.Println("Missing scope argument for OAuth 2.0")
+					return
 				}
+			}
+
+			json, err := readJSON(credentials)
+			if err != nil {
+				fmt.Println("Failed to open file: " + credentials)
+				fmt.Println(err.Error())
+				return
+			}
 
-				// Start localhost server
-				adr, err := authCodeServer.ListenAndServe(redirectUri)
+			var authCodeServer util.AuthorizationCodeServer = nil
+			var consentPageSettings util.ConsentPageSettings
+			if authorize {
+				json, authCodeServer, consentPageSettings, err = startLoopbackAuthCodeServer(commonOpts.consentPageOptions, json)
 				if err != nil {
 					fmt.Println(err)
 					return
 				}
-				// Close localhost server's port on exit
-				defer authCodeServer.Close()
-
-				// If a different dynamic redirect uri was created, replace the redirect uri in file.
-				// this happens if the original redirect does not have a port for the localhost.
-				redirectUri = fmt.Sprintf("\"%s\"", redirectUri)
-				adr = fmt.Sprintf("\"%s\"", adr)
-				json = strings.Replace(json, redirectUri, adr, -1)
+				if authCodeServer != nil {
+					// Close localhost server's port on exit
+					defer authCodeServer.Close()
+				}
 			}
 
 			// 3LO or 2LO depending on the credential type.
 			// For 2LO flow AuthHandler, State and ConsentPageSettings are not needed.
 			settings = &util.Settings{
-				CredentialsJSON: json,
-				Scope:           parseScopes(scopes),
-				AuthHandler:     util.Get3LOAuthorizationHandler(defaultState, consentPageSettings, &authCodeServer),
-				State:           defaultState,
-				Audience:        audience,
-				QuotaProject:    quotaProject,
-				Sts:             sts,
-				ServiceAccount:  serviceAccount,
-				Email:           email,
-				AuthType:        util.AuthTypeOAuth,
+				CredentialsJSON:        json,
+				Scope:                  parseScopes(scopes),
+				AuthHandler:            util.Get3LOAuthorizationHandler(defaultState, consentPageSettings, &authCodeServer),
+				State:                  defaultState,
+				Audience:               audience,
+				QuotaProject:           quotaProject,
+				Sts:                    sts,
+				ServiceAccount:         serviceAccount,
+				Delegates:              delegates,
+				ServiceAccountLifetime: lifetime,
+				Email:                  email,
+				AuthType:               authType,
+			}
+		}
+		settings.AccessBoundary = accessBoundary
+		settings.StsEndpoint = commonOpts.StsEndpoint
+
+		if err := task(settings, taskSettings); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if cmd == "exchange" {
+		exchangeOpts := opts.Exchange
+		if err := setCacheStore(exchangeOpts.Cache); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		setCacheKeyFile(exchangeOpts.CacheKeyFile)
+
+		subjectToken, err := readToken(exchangeOpts.SubjectTokenFile)
+		if err != nil {
+			fmt.Println("Failed to read subject token")
+			fmt.Println(err.Error())
+			return
+		}
+		if subjectToken == "" {
+			fmt.Println("Missing subject token")
+			return
+		}
+		request := &util.TokenExchangeRequest{
+			Endpoint:           exchangeOpts.Endpoint,
+			SubjectToken:       subjectToken,
+			SubjectTokenType:   parseTokenType(exchangeOpts.SubjectTokenType),
+			Resource:           exchangeOpts.Resource,
+			Audience:           exchangeOpts.Audience,
+			RequestedTokenType: parseTokenType(exchangeOpts.RequestedTokenType),
+		}
+		if exchangeOpts.ActorTokenFile != "" {
+			actorToken, err := readToken(exchangeOpts.ActorTokenFile)
+			if err != nil {
+				fmt.Println("Failed to read actor token")
+				fmt.Println(err.Error())
+				return
 			}
+			request.ActorToken = actorToken
+			request.ActorTokenType = parseTokenType(exchangeOpts.ActorTokenType)
+		}
+		var scope string
+		if exchangeOpts.Scope != "" {
+			scope = strings.Join(getScopesWithFallback(exchangeOpts.Scope), " ")
+		}
+
+		settings := &util.Settings{
+			AuthType:      util.AuthTypeExchange,
+			Scope:         scope,
+			TokenExchange: request,
+		}
+		taskSettings := &util.TaskSettings{
+			AuthType:    util.AuthTypeExchange,
+			Format:      exchangeOpts.Format,
+			MinValidity: exchangeOpts.MinValidity,
+			CacheTTL:    exchangeOpts.CacheTTL,
+		}
+		if err := util.Fetch(settings, taskSettings); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if cmd == "sign" {
+		// Unlike other commands, all failures exit with status 1, since
+		// signatures are meant to be used in pipelines.
+		signOpts := opts.Sign
+		if err := setCacheStore(signOpts.Cache); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
 		}
+		setCacheKeyFile(signOpts.CacheKeyFile)
+		setIamEndpoint(signOpts.IamEndpoint)
 
-		task(settings, taskSettings)
+		delegates := parseDelegates(signOpts.Delegates)
+		if signOpts.ServiceAccount == "" && len(delegates) > 0 {
+			fmt.Println("--delegates requires --impersonate-service-account")
+			os.Exit(1)
+		}
+		if signOpts.ServiceAccount != "" && (signOpts.SigningKey != "" || signOpts.Algorithm != "" || signOpts.KeyID != "") {
+			fmt.Println("--signing-key, --alg and --kid cannot be used with --impersonate-service-account")
+			os.Exit(1)
+		}
+		payload, err := readPayload(signOpts.Payload)
+		if err != nil {
+			fmt.Println("Failed to read payload")
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		signingKey, err := readSigningKey(signOpts.SigningKey, signOpts.KeyID)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		json, err := readJSON(signOpts.Credentials)
+		if err != nil {
+			fmt.Println("Failed to open file: " + signOpts.Credentials)
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		// IAM is called on behalf of the credentials, which may require user consent.
+		var authCodeServer util.AuthorizationCodeServer = nil
+		var consentPageSettings util.ConsentPageSettings
+		if signOpts.ServiceAccount != "" {
+			json, authCodeServer, consentPageSettings, err = startLoopbackAuthCodeServer(signOpts.consentPageOptions, json)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if authCodeServer != nil {
+				// Close localhost server's port on exit
+				defer authCodeServer.Close()
+			}
+		}
+
+		settings := &util.Settings{
+			CredentialsJSON: json,
+			AuthHandler:     util.Get3LOAuthorizationHandler(defaultState, consentPageSettings, &authCodeServer),
+			State:           defaultState,
+			ServiceAccount:  signOpts.ServiceAccount,
+			Delegates:       delegates,
+			JWT: &util.JWTSettings{
+				SigningKey: signingKey,
+				Algorithm:  signOpts.Algorithm,
+				KeyID:      signOpts.KeyID,
+			},
+		}
+		// The token used to call IAM only needs to outlive the request.
+		taskSettings := &util.TaskSettings{
+			Format:      signOpts.Format,
+			NoPrompt:    signOpts.NoPrompt,
+			MinValidity: time.Minute,
+		}
+		if err := util.Sign(settings, taskSettings, &util.SignRequest{Payload: payload, JWT: signOpts.JWT}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	} else if task, ok := infoTasks[cmd]; ok {
 		infoOpts := getInfoOptions(opts, cmd)
 		token := infoOpts.Token
@@ -438,6 +1262,9 @@ func main() {
 			}
 		}
 
+		if infoOpts.Issuer != "" {
+			os.Exit(issuerTasks[cmd](infoOpts.Issuer, token))
+		}
 		os.Exit(task(token))
 	} else if cmd == "web" {
 		setWebDirectory(opts.Web.Directory)
@@ -448,7 +1275,76 @@ func main() {
 		}
 
 	} else if cmd == "reset" {
-		setCacheLocation(opts.Reset.Cache)
-		util.Reset()
+		if err := setCacheStore(opts.Reset.Cache); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		if opts.Reset.Revoke {
+			setCacheKeyFile(opts.Reset.CacheKeyFile)
+			if err := util.ResetAndRevoke(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		} else {
+			util.Reset()
+		}
+	} else if cmd == "cache" {
+		switch parser.Active.Active.Name {
+		case "list":
+			if err := setCacheStore(opts.Cache.List.Cache); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			setCacheKeyFile(opts.Cache.List.CacheKeyFile)
+			filter, err := getCacheFilter(opts.Cache.List.cacheFilterOptions)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			if err := util.CacheList(filter); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case "show":
+			if err := setCacheStore(opts.Cache.Show.Cache); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			setCacheKeyFile(opts.Cache.Show.CacheKeyFile)
+			id := opts.Cache.Show.ID
+			// Fallback to reading ID from remaining args.
+			if id == "" {
+				if len(remainingArgs) > 0 {
+					id = remainingArgs[0]
+				} else {
+					fmt.Println("Missing ID of the cached token")
+					os.Exit(1)
+				}
+			}
+			if err := util.CacheShow(id); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		case "delete":
+			if err := setCacheStore(opts.Cache.Delete.Cache); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			setCacheKeyFile(opts.Cache.Delete.CacheKeyFile)
+			filterOpts := opts.Cache.Delete.cacheFilterOptions
+			if filterOpts == (cacheFilterOptions{}) && !opts.Cache.Delete.All {
+				fmt.Println("Missing filter argument. Use --all to delete all cached tokens.")
+				os.Exit(1)
+			}
+			filter, err := getCacheFilter(filterOpts)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+			if err := util.CacheDelete(filter); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
 	}
 }
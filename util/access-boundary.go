@@ -0,0 +1,145 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// access-boundary implements downscoping of access tokens with
+// Credential Access Boundaries.
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// AccessBoundary restricts the resources and permissions available to a
+// downscoped token.
+type AccessBoundary struct {
+	AccessBoundaryRules []AccessBoundaryRule `json:"accessBoundaryRules"`
+}
+
+// AccessBoundaryRule makes a subset of the permissions of the source token
+// available on a resource.
+type AccessBoundaryRule struct {
+	// Full resource name, such as //storage.googleapis.com/projects/_/buckets/my-bucket.
+	AvailableResource string `json:"availableResource"`
+	// Permissions, prefixed by "inRole:", such as inRole:roles/storage.objectViewer.
+	AvailablePermissions []string `json:"availablePermissions"`
+	// Optional IAM condition that further restricts the rule.
+	AvailabilityCondition *AvailabilityCondition `json:"availabilityCondition,omitempty"`
+}
+
+// AvailabilityCondition is a CEL expression restricting an access boundary rule.
+type AvailabilityCondition struct {
+	Expression  string `json:"expression"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ParseAccessBoundary parses an access boundary file. Both the STS options
+// format {"accessBoundary": {"accessBoundaryRules": [...]}} and the bare
+// {"accessBoundaryRules": [...]} format are accepted.
+func ParseAccessBoundary(data []byte) (*AccessBoundary, error) {
+	var options struct {
+		AccessBoundary      *AccessBoundary      `json:"accessBoundary"`
+		AccessBoundaryRules []AccessBoundaryRule `json:"accessBoundaryRules"`
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("Failed to parse access boundary: %v", err)
+	}
+	boundary := options.AccessBoundary
+	if boundary == nil {
+		boundary = &AccessBoundary{options.AccessBoundaryRules}
+	}
+	if err := boundary.validate(); err != nil {
+		return nil, err
+	}
+	return boundary, nil
+}
+
+// ParseAccessBoundaryRule parses an inline rule of the form
+// RESOURCE;PERMISSION[,PERMISSION...][;CONDITION]. Permissions without
+// the "inRole:" prefix are prefixed with it.
+func ParseAccessBoundaryRule(rule string) (AccessBoundaryRule, error) {
+	parts := strings.SplitN(rule, ";", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return AccessBoundaryRule{}, fmt.Errorf("Invalid access boundary rule: %s. "+
+			"Expected RESOURCE;PERMISSION[,PERMISSION...][;CONDITION]", rule)
+	}
+	parsed := AccessBoundaryRule{AvailableResource: strings.TrimSpace(parts[0])}
+	for _, permission := range strings.Split(parts[1], ",") {
+		permission = strings.TrimSpace(permission)
+		if !strings.HasPrefix(permission, "inRole:") {
+			permission = "inRole:" + permission
+		}
+		parsed.AvailablePermissions = append(parsed.AvailablePermissions, permission)
+	}
+	if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+		parsed.AvailabilityCondition = &AvailabilityCondition{Expression: strings.TrimSpace(parts[2])}
+	}
+	return parsed, nil
+}
+
+// Returns an error if the boundary has no rules, or a rule is incomplete.
+func (boundary *AccessBoundary) validate() error {
+	if len(boundary.AccessBoundaryRules) == 0 {
+		return errors.New("Access boundary must contain at least one rule")
+	}
+	for _, rule := range boundary.AccessBoundaryRules {
+		if rule.AvailableResource == "" || len(rule.AvailablePermissions) == 0 {
+			return errors.New("Access boundary rules require availableResource and availablePermissions")
+		}
+	}
+	return nil
+}
+
+// Returns the compact JSON encoding of the boundary, or an empty string for nil.
+func (boundary *AccessBoundary) String() string {
+	if boundary == nil {
+		return ""
+	}
+	data, _ := json.Marshal(boundary)
+	return string(data)
+}
+
+// DownscopeToken exchanges the access token at the STS endpoint for a token
+// restricted by the access boundary. The endpoint defaults to Google STS.
+// The downscoped token expires with the source token if STS does not report
+// its lifetime.
+func DownscopeToken(source *oauth2.Token, boundary *AccessBoundary, endpoint string) (*oauth2.Token, error) {
+	if endpoint == "" {
+		endpoint = GoogleStsTokenURL
+	}
+	options, err := json.Marshal(map[string]*AccessBoundary{"accessBoundary": boundary})
+	if err != nil {
+		return nil, err
+	}
+	token, err := ExchangeToken(&TokenExchangeRequest{
+		Endpoint:           endpoint,
+		SubjectToken:       source.AccessToken,
+		SubjectTokenType:   TokenTypeAccessToken,
+		RequestedTokenType: TokenTypeAccessToken,
+		Options:            string(options),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token.Expiry.IsZero() {
+		token.Expiry = source.Expiry
+	}
+	return token, nil
+}
@@ -0,0 +1,63 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// api-key implements the output of Google API keys, which are sent as is
+// instead of being exchanged for tokens.
+package util
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Header used to send API keys to Google APIs.
+const APIKeyHeader = "X-Goog-Api-Key"
+
+// Query parameter used to send API keys to Google APIs.
+const apiKeyParam = "key"
+
+// Returns the given API key in header format.
+func BuildAPIKeyHeader(apiKey string) string {
+	return fmt.Sprintf("%s: %s", APIKeyHeader, apiKey)
+}
+
+// Returns the given URL with the API key added as "key" query parameter.
+func addAPIKeyParam(rawURL string, apiKey string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(apiKeyParam, apiKey)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Prints the API key with the specified format. API keys do not expire
+// and carry no other information, so only bare, header and pretty formats
+// are supported. Returns an error for other formats.
+func printAPIKey(apiKey string, format string) error {
+	switch format {
+	case formatBare:
+		fmt.Println(apiKey)
+	case formatHeader:
+		fmt.Println(BuildAPIKeyHeader(apiKey))
+	case formatPretty:
+		fmt.Printf("Fetched credentials of type:\n  %s\nAPI Key:\n  %s\n", AuthTypeAPIKey, apiKey)
+	default:
+		return fmt.Errorf("Output format %s is not supported for API keys", format)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// cache-encryption implements encryption at rest for the token cache
+// using AES-256-GCM.
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variable holding the cache encryption key.
+const CacheKeyEnvVar = "OAUTH2L_CACHE_KEY"
+
+// Header of encrypted cache files, followed by the base64 encoded
+// nonce and ciphertext.
+const encryptedCacheHeader = "oauth2l-encrypted-cache:v1\n"
+
+// Minimum length of the cache key material. The key is derived from the
+// material without a salt or work factor, so it must be high-entropy random
+// data rather than a passphrase.
+const minCacheKeyLength = 32
+
+// Path to a file containing the cache encryption key. Takes precedence
+// over the OAUTH2L_CACHE_KEY environment variable.
+var CacheKeyFile string
+
+// Returns the AES-256 key used to encrypt the cache, derived from the
+// configured key material. Returns nil if no key is configured, and an
+// error if the material is too short to be a random key.
+func cacheEncryptionKey() ([]byte, error) {
+	material := os.Getenv(CacheKeyEnvVar)
+	if CacheKeyFile != "" {
+		data, err := ioutil.ReadFile(CacheKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read cache key file: %v", err)
+		}
+		material = string(data)
+	}
+	material = strings.TrimSpace(material)
+	if material == "" {
+		return nil, nil
+	}
+	if len(material) < minCacheKeyLength {
+		return nil, fmt.Errorf("Cache key must be at least %d characters of random data, "+
+			"such as the output of openssl rand -base64 32.", minCacheKeyLength)
+	}
+	key := sha256.Sum256([]byte(material))
+	return key[:], nil
+}
+
+// Returns true if data was written by encryptCache.
+func isEncryptedCache(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedCacheHeader))
+}
+
+func newCacheCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts the serialized cache with the given key.
+func encryptCache(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newCacheCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(encryptedCacheHeader))
+	return []byte(encryptedCacheHeader + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Encrypts data if a cache key is configured, and returns it unchanged
+// otherwise.
+func encryptCacheIfKeyed(data []byte) ([]byte, error) {
+	key, err := cacheEncryptionKey()
+	if err != nil || key == nil {
+		return data, err
+	}
+	return encryptCache(key, data)
+}
+
+// Decrypts data if it was written by encryptCache, and returns it
+// unchanged otherwise.
+func decryptCacheIfEncrypted(data []byte) ([]byte, error) {
+	if !isEncryptedCache(data) {
+		return data, nil
+	}
+	key, err := cacheEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	return decryptCache(key, data)
+}
+
+// Decrypts data written by encryptCache with the given key.
+func decryptCache(key []byte, data []byte) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("Cache is encrypted, but no key is configured. "+
+			"Set %s or use --cache-key-file.", CacheKeyEnvVar)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(data[len(encryptedCacheHeader):]))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newCacheCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted cache file is truncated")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(encryptedCacheHeader))
+	if err != nil {
+		return nil, errors.New("Failed to decrypt cache file. Is the cache key correct?")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,41 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package util
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Acquires an exclusive POSIX record lock on the byte at offset,
+// waiting until it is available.
+func lockFileRange(f *os.File, offset int64) error {
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart, Start: offset, Len: 1}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lk)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFileRange(f *os.File, offset int64) error {
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart, Start: offset, Len: 1}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
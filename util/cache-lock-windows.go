@@ -0,0 +1,38 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package util
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func overlappedAt(offset int64) *windows.Overlapped {
+	return &windows.Overlapped{Offset: uint32(offset), OffsetHigh: uint32(offset >> 32)}
+}
+
+// Acquires an exclusive lock on the byte at offset, waiting until it
+// is available.
+func lockFileRange(f *os.File, offset int64) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, overlappedAt(offset))
+}
+
+func unlockFileRange(f *os.File, offset int64) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, overlappedAt(offset))
+}
@@ -0,0 +1,100 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// cache-lock implements advisory locks that coordinate concurrent oauth2l
+// processes sharing the same cache.
+//
+// All locks are byte-range locks on a single lock file of the cache store.
+// The first byte guards updates of the cache file. Every cache key maps to
+// another byte, which is held while the token for that key is fetched, so
+// that concurrent processes wait for and reuse a single fetched token.
+package util
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// Offset of the lock that guards read-modify-write updates of the cache.
+const cacheUpdateLockOffset = 0
+
+var (
+	// Guards lockFiles and rangeMutexes.
+	lockMutex sync.Mutex
+	// Lock files opened by this process, by name. Lock files are never
+	// closed, since closing any descriptor of a file releases all the
+	// POSIX record locks held on it by the process.
+	lockFiles = map[string]*os.File{}
+	// Record locks do not exclude goroutines of the same process, so every
+	// byte range is additionally guarded by a mutex.
+	rangeMutexes = map[lockRange]*sync.Mutex{}
+)
+
+// Identifies a byte of a lock file.
+type lockRange struct {
+	name   string
+	offset int64
+}
+
+// Acquires the lock for fetching the token identified by the given settings.
+// Blocks while another process holds the lock for the same key.
+// Returns a function that releases the lock.
+func lockCacheKey(settings *Settings) (func(), error) {
+	if Cache == nil {
+		return func() {}, nil
+	}
+	return Cache.Lock(createKey(settings).Digest())
+}
+
+// Acquires the lock of the given lock file for fetching the token
+// identified by the digest.
+func lockCacheDigest(name string, digest string) (func(), error) {
+	h := fnv.New32a()
+	h.Write([]byte(digest))
+	return lockCacheRange(name, cacheUpdateLockOffset+1+int64(h.Sum32()))
+}
+
+// Acquires the given byte of the lock file with the given name.
+// Returns a function that releases the lock.
+func lockCacheRange(name string, offset int64) (func(), error) {
+	lockMutex.Lock()
+	f, ok := lockFiles[name]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			lockMutex.Unlock()
+			return nil, err
+		}
+		lockFiles[name] = f
+	}
+	m, ok := rangeMutexes[lockRange{name, offset}]
+	if !ok {
+		m = &sync.Mutex{}
+		rangeMutexes[lockRange{name, offset}] = m
+	}
+	lockMutex.Unlock()
+
+	m.Lock()
+	if err := lockFileRange(f, offset); err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFileRange(f, offset)
+		m.Unlock()
+	}, nil
+}
@@ -0,0 +1,149 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// cache-store-dir implements a cache store that keeps every entry in its
+// own file, so that lookups and updates only touch a single entry.
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the lock file in the cache directory.
+const dirCacheLockName = ".lock"
+
+// dirCacheStore keeps the cache in a directory, with one file per entry
+// named after the hex encoded digest. Entries are written atomically, so
+// no update lock is required.
+type dirCacheStore struct {
+	dir string
+}
+
+// NewDirCacheStore returns a store backed by the directory at the given
+// path, which is created on first use.
+func NewDirCacheStore(dir string) CacheStore {
+	return &dirCacheStore{dir: dir}
+}
+
+func (s *dirCacheStore) Get(digest string) ([]byte, error) {
+	if !strings.HasPrefix(digest, cacheKeyDigestPrefix) {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(s.entryPath(digest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if isEncryptedCache(data) {
+		return decryptCacheIfEncrypted(data)
+	}
+	// Plaintext entries are encrypted as soon as a key is configured.
+	if key, err := cacheEncryptionKey(); err != nil {
+		return nil, err
+	} else if key != nil {
+		if err := s.Put(digest, data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (s *dirCacheStore) Put(digest string, val []byte) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	data, err := encryptCacheIfKeyed(val)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.entryPath(digest), data)
+}
+
+func (s *dirCacheStore) Delete(digests ...string) error {
+	for _, digest := range digests {
+		err := os.Remove(s.entryPath(digest))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dirCacheStore) List() (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		digest, ok := s.entryDigest(file)
+		if !ok {
+			continue
+		}
+		val, err := s.Get(digest)
+		if err != nil {
+			return nil, err
+		}
+		// Skip entries deleted since the directory was read.
+		if val != nil {
+			m[digest] = val
+		}
+	}
+	return m, nil
+}
+
+func (s *dirCacheStore) Clear() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		// Noop if directory does not exist.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var digests []string
+	for _, file := range files {
+		if digest, ok := s.entryDigest(file); ok {
+			digests = append(digests, digest)
+		}
+	}
+	return s.Delete(digests...)
+}
+
+func (s *dirCacheStore) Lock(digest string) (func(), error) {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return nil, err
+	}
+	return lockCacheDigest(filepath.Join(s.dir, dirCacheLockName), digest)
+}
+
+func (s *dirCacheStore) entryPath(digest string) string {
+	return filepath.Join(s.dir, strings.TrimPrefix(digest, cacheKeyDigestPrefix))
+}
+
+// Returns the digest of the entry stored in the given file. Returns false
+// for the lock file and temporary files.
+func (s *dirCacheStore) entryDigest(file os.FileInfo) (string, bool) {
+	name := file.Name()
+	if file.IsDir() || len(name) != 64 || strings.Trim(name, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return cacheKeyDigestPrefix + name, true
+}
@@ -0,0 +1,190 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// cache-store-file implements a cache store that keeps all entries in a
+// single JSON file, optionally encrypted.
+package util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fileCacheStore keeps the cache in a single file. Every operation
+// reads the whole file, and updates rewrite it while holding the update
+// lock of the lock file next to it.
+type fileCacheStore struct {
+	path string
+}
+
+// NewFileCacheStore returns a store backed by the file at the given path.
+func NewFileCacheStore(path string) CacheStore {
+	return &fileCacheStore{path: path}
+}
+
+func (s *fileCacheStore) Get(digest string) ([]byte, error) {
+	cache, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	return cache[digest], nil
+}
+
+func (s *fileCacheStore) Put(digest string, val []byte) error {
+	return s.update(func(cache map[string][]byte) bool {
+		cache[digest] = val
+		return true
+	})
+}
+
+func (s *fileCacheStore) Delete(digests ...string) error {
+	return s.update(func(cache map[string][]byte) bool {
+		deleted := false
+		for _, digest := range digests {
+			if _, ok := cache[digest]; ok {
+				delete(cache, digest)
+				deleted = true
+			}
+		}
+		return deleted
+	})
+}
+
+func (s *fileCacheStore) List() (map[string][]byte, error) {
+	unlock, err := s.lockUpdate()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.load()
+}
+
+func (s *fileCacheStore) Clear() error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		// Noop if file does not exist.
+		return nil
+	}
+	return os.Remove(s.path)
+}
+
+func (s *fileCacheStore) Lock(digest string) (func(), error) {
+	return lockCacheDigest(s.lockPath(), digest)
+}
+
+func (s *fileCacheStore) lockPath() string {
+	return s.path + ".lock"
+}
+
+func (s *fileCacheStore) lockUpdate() (func(), error) {
+	return lockCacheRange(s.lockPath(), cacheUpdateLockOffset)
+}
+
+// Applies modify to the cache while holding the update lock, and saves
+// the cache if modify returns true.
+func (s *fileCacheStore) update(modify func(cache map[string][]byte) bool) error {
+	unlock, err := s.lockUpdate()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cache, err := s.load()
+	if err != nil {
+		return err
+	}
+	if !modify(cache) {
+		return nil
+	}
+	return s.save(cache)
+}
+
+func (s *fileCacheStore) load() (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := cacheEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	plaintext := !isEncryptedCache(data)
+	if !plaintext {
+		data, err = decryptCache(key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Migrate caches written by previous versions: plaintext caches are
+	// encrypted as soon as a key is configured, and legacy keys are
+	// replaced by their digests.
+	migrated := migrateLegacyKeys(m)
+	if migrated || (plaintext && key != nil && len(m) > 0) {
+		if err := s.save(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Writes the cache atomically with owner-only permissions, encrypting
+// it if a cache key is configured.
+func (s *fileCacheStore) save(cache map[string][]byte) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	data, err = encryptCacheIfKeyed(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Writes data to a temporary file with mode 0600 in the same directory
+// and renames it over filename, so that readers never observe a partially
+// written file.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,191 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// cache-store implements the storage backends of the token cache.
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Selector prefixes of the cache storage backends.
+const (
+	FileCacheStorePrefix   = "file:"
+	DirCacheStorePrefix    = "dir:"
+	MemoryCacheStorePrefix = "memory:"
+)
+
+// CacheStore is a storage backend of the token cache. Values are opaque
+// to the store and identified by the digest of their CacheKey.
+type CacheStore interface {
+	// Get returns the value stored for the digest, or nil if there is none.
+	Get(digest string) ([]byte, error)
+	// Put stores the value for the digest, replacing any previous value.
+	Put(digest string, val []byte) error
+	// Delete removes the values stored for the given digests.
+	Delete(digests ...string) error
+	// List returns all values in the store by digest.
+	List() (map[string][]byte, error)
+	// Clear removes all values from the store.
+	Clear() error
+	// Lock acquires an exclusive lock for fetching the token identified by
+	// the digest, and returns a function that releases the lock.
+	Lock(digest string) (func(), error)
+}
+
+// CacheLocation is the path of the cache file used by the default store.
+// An empty location disables caching.
+//
+// Deprecated: Set Cache instead, e.g. to NewFileCacheStore(path). The
+// location is only used while Cache is the default store.
+var CacheLocation string = filepath.Join(GuessUnixHomeDir(), CacheFileName)
+
+// The store used by the cache functions. Caching is disabled if nil.
+var Cache CacheStore = locationCacheStore{}
+
+// locationCacheStore is the default store, which uses the file at
+// CacheLocation when called, so that changes to CacheLocation take effect.
+type locationCacheStore struct{}
+
+// Returns the store for the current CacheLocation.
+func (locationCacheStore) store() CacheStore {
+	if CacheLocation == "" {
+		// Nothing outlives the call, as if caching were disabled.
+		return NewMemoryCacheStore()
+	}
+	return NewFileCacheStore(CacheLocation)
+}
+
+func (s locationCacheStore) Get(digest string) ([]byte, error) {
+	return s.store().Get(digest)
+}
+
+func (s locationCacheStore) Put(digest string, val []byte) error {
+	return s.store().Put(digest, val)
+}
+
+func (s locationCacheStore) Delete(digests ...string) error {
+	return s.store().Delete(digests...)
+}
+
+func (s locationCacheStore) List() (map[string][]byte, error) {
+	return s.store().List()
+}
+
+func (s locationCacheStore) Clear() error {
+	return s.store().Clear()
+}
+
+func (s locationCacheStore) Lock(digest string) (func(), error) {
+	return s.store().Lock(digest)
+}
+
+// ParseCacheStore returns the store described by the selector, which is
+// one of "file:PATH", "dir:PATH" or "memory:". A selector without prefix
+// is a path to a cache file, and an empty selector disables caching.
+func ParseCacheStore(selector string) (CacheStore, error) {
+	switch {
+	case selector == "":
+		return nil, nil
+	case strings.HasPrefix(selector, FileCacheStorePrefix):
+		path := strings.TrimPrefix(selector, FileCacheStorePrefix)
+		if path == "" {
+			return nil, fmt.Errorf("Missing path in cache selector: %s", selector)
+		}
+		return NewFileCacheStore(path), nil
+	case strings.HasPrefix(selector, DirCacheStorePrefix):
+		path := strings.TrimPrefix(selector, DirCacheStorePrefix)
+		if path == "" {
+			return nil, fmt.Errorf("Missing path in cache selector: %s", selector)
+		}
+		return NewDirCacheStore(path), nil
+	case selector == MemoryCacheStorePrefix:
+		return NewMemoryCacheStore(), nil
+	case strings.HasPrefix(selector, MemoryCacheStorePrefix):
+		return nil, fmt.Errorf("Unexpected path in cache selector: %s", selector)
+	}
+	return NewFileCacheStore(selector), nil
+}
+
+// memoryCacheStore keeps the cache in memory, for library users that
+// must not persist tokens.
+type memoryCacheStore struct {
+	// Guards values and locks.
+	mu     sync.Mutex
+	values map[string][]byte
+	locks  map[string]*sync.Mutex
+}
+
+// NewMemoryCacheStore returns an empty in-memory store.
+func NewMemoryCacheStore() CacheStore {
+	return &memoryCacheStore{
+		values: map[string][]byte{},
+		locks:  map[string]*sync.Mutex{},
+	}
+}
+
+func (s *memoryCacheStore) Get(digest string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[digest], nil
+}
+
+func (s *memoryCacheStore) Put(digest string, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[digest] = val
+	return nil
+}
+
+func (s *memoryCacheStore) Delete(digests ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, digest := range digests {
+		delete(s.values, digest)
+	}
+	return nil
+}
+
+func (s *memoryCacheStore) List() (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string][]byte, len(s.values))
+	for digest, val := range s.values {
+		values[digest] = val
+	}
+	return values, nil
+}
+
+func (s *memoryCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string][]byte{}
+	return nil
+}
+
+func (s *memoryCacheStore) Lock(digest string) (func(), error) {
+	s.mu.Lock()
+	m, ok := s.locks[digest]
+	if !ok {
+		m = &sync.Mutex{}
+		s.locks[digest] = m
+	}
+	s.mu.Unlock()
+	m.Lock()
+	return m.Unlock, nil
+}
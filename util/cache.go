@@ -15,21 +15,22 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
-	"log"
 	"os"
 	"os/user"
-	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 )
 
 const CacheFileName = ".oauth2l"
 
-var CacheLocation string = filepath.Join(GuessUnixHomeDir(), CacheFileName)
+// Prefix of the digests used as keys in the cache file.
+const cacheKeyDigestPrefix = "sha256:"
 
 // The key struct that used to identify an auth token fetch operation.
 type CacheKey struct {
@@ -49,103 +50,522 @@ type CacheKey struct {
 	Sts bool
 	// Exchange User access token for Service Account access token.
 	ServiceAccount string
+	// The delegation chain used for impersonating ServiceAccount.
+	Delegates []string
+	// The requested lifetime of the impersonated access token.
+	Lifetime time.Duration
+	// If specified, an ID token for the audience is requested.
+	IDToken bool
+	// If specified, the token is obtained by an RFC 8693 token exchange.
+	TokenExchange *TokenExchangeRequest
+	// If specified, the token is downscoped to the access boundary.
+	AccessBoundary *AccessBoundary
+	// The CI provider and Workload Identity Provider of federated tokens.
+	CIProvider               string
+	WorkloadIdentityProvider string
+	// The host of the metadata server, for tokens fetched from it.
+	MetadataHost string
+	// If specified, the token is obtained from a generic OAuth 2.0 provider.
+	Provider *ProviderConfig
+	// Custom claims of self-signed JWTs.
+	JWT *JWTSettings
 }
 
+// Describes the key of a cache entry without revealing any credentials.
+type CacheKeyInfo struct {
+	// The authentication type used to fetch the token.
+	AuthType string `json:"auth_type,omitempty"`
+	// The type of the credentials file, or empty for none.
+	CredentialType string `json:"credential_type,omitempty"`
+	// The service account email, client ID or pool provider of the credentials.
+	Principal string `json:"principal,omitempty"`
+	// Digest of the identifying fields of the credentials file.
+	CredentialsDigest string `json:"credentials_digest,omitempty"`
+	Scope             string `json:"scope,omitempty"`
+	Audience          string `json:"audience,omitempty"`
+	Email             string `json:"email,omitempty"`
+	QuotaProject      string `json:"quota_project,omitempty"`
+	Sts               bool   `json:"sts,omitempty"`
+	ServiceAccount    string `json:"service_account,omitempty"`
+	// The comma delimited delegation chain of the impersonation.
+	Delegates string `json:"delegates,omitempty"`
+	Lifetime  string `json:"lifetime,omitempty"`
+	// If true, the token is an ID token rather than an access token.
+	IDToken bool `json:"id_token,omitempty"`
+	// Digest of the token exchange parameters, including the subject token.
+	TokenExchangeDigest string `json:"token_exchange_digest,omitempty"`
+	// Digest of the client and endpoints of a generic provider.
+	ProviderDigest string `json:"provider_digest,omitempty"`
+	// The revocation endpoint, if it is not Google's.
+	RevocationURL string `json:"revocation_url,omitempty"`
+	// Digest of the custom claims of self-signed JWTs.
+	JWTDigest string `json:"jwt_digest,omitempty"`
+	// The JSON encoded access boundary of downscoped tokens.
+	AccessBoundary string `json:"access_boundary,omitempty"`
+}
+
+// A token in the cache, along with a description of its key.
+type CacheEntry struct {
+	// The digest identifying the entry in the cache.
+	Digest string
+	Key    CacheKeyInfo
+	Token  *oauth2.Token
+	// The time the token was cached, or zero if unknown.
+	CachedAt time.Time
+}
+
+// The format of the values in the cache file.
+type cacheValueJSON struct {
+	Key      CacheKeyInfo    `json:"key"`
+	Token    json.RawMessage `json:"token"`
+	CachedAt *time.Time      `json:"cached_at,omitempty"`
+}
+
+// Returns the cached token for the given settings. If there is no unexpired
+// token for the requested scopes, an unexpired token granted for a superset
+// of the scopes is returned instead.
 func LookupCache(settings *Settings) (*oauth2.Token, error) {
-	if CacheLocation == "" {
+	entry, err := lookupCacheEntry(settings, func(entry *CacheEntry) bool {
+		return !isTokenExpired(entry.Token)
+	})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.Token, nil
+}
+
+// Returns the cache entry for the given settings. If the entry is missing
+// or not usable, a usable entry for a superset of the requested scopes is
+// returned instead, if any. Otherwise, the unusable entry is returned, or
+// nil if there is none.
+func lookupCacheEntry(settings *Settings, usable func(entry *CacheEntry) bool) (*CacheEntry, error) {
+	if Cache == nil {
 		return nil, nil
 	}
-	var cache, err = loadCache()
+	digest := createKey(settings).Digest()
+	var entry *CacheEntry
+	val, err := Cache.Get(digest)
 	if err != nil {
 		return nil, err
+	} else if val != nil {
+		entry, err = decodeCacheEntry(digest, val)
+		if err != nil {
+			return nil, err
+		}
+		if usable(entry) {
+			return entry, nil
+		}
 	}
-	key, err := json.Marshal(createKey(settings))
+	superset, err := lookupSupersetEntry(settings, usable)
+	if err != nil || superset != nil {
+		return superset, err
+	}
+	return entry, nil
+}
+
+// Returns a usable cache entry for the same credentials and parameters as
+// the given settings, whose granted scopes include all requested scopes.
+func lookupSupersetEntry(settings *Settings, usable func(entry *CacheEntry) bool) (*CacheEntry, error) {
+	key := createKey(settings)
+	if key.Scope == "" || key.APIKey != "" {
+		return nil, nil
+	}
+	entries, err := ListCache()
 	if err != nil {
 		return nil, err
 	}
-	val := cache[string(key)]
-	return UnmarshalWithExtras(val)
+	info := key.Info()
+	info.AuthType = settings.GetAuthType()
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Key.matchesExceptScope(info) && containsScopes(entry.grantedScope(), info.Scope) && usable(entry) {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns true if both keys describe the same credentials and parameters,
+// ignoring the scopes.
+func (info CacheKeyInfo) matchesExceptScope(other CacheKeyInfo) bool {
+	if info.authType() != other.authType() {
+		return false
+	}
+	info.AuthType, other.AuthType = "", ""
+	info.Scope, other.Scope = "", ""
+	return info == other
+}
+
+// Returns the auth type of the key. Keys stored without auth type by
+// previous versions are assumed to be OAuth keys, so that their tokens
+// are never reused for other auth types.
+func (info CacheKeyInfo) authType() string {
+	if info.AuthType == "" {
+		return AuthTypeOAuth
+	}
+	return info.AuthType
+}
+
+// Returns the scopes granted to the cached token, as reported by the token
+// endpoint, or the requested scopes if the token endpoint did not report them.
+func (entry *CacheEntry) grantedScope() string {
+	if scope, ok := entry.Token.Extra("scope").(string); ok && scope != "" {
+		return scope
+	}
+	return entry.Key.Scope
+}
+
+// Returns true if the space delimited granted scopes include all requested scopes.
+func containsScopes(granted string, requested string) bool {
+	grantedScopes := strings.Fields(granted)
+	for _, scope := range strings.Fields(requested) {
+		if !containsString(grantedScopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the space delimited scopes sorted and without duplicates, so that
+// the same set of scopes always yields the same cache key.
+func normalizeScope(scope string) string {
+	scopes := strings.Fields(scope)
+	sort.Strings(scopes)
+	var normalized []string
+	for i, s := range scopes {
+		if i == 0 || s != scopes[i-1] {
+			normalized = append(normalized, s)
+		}
+	}
+	return strings.Join(normalized, " ")
 }
 
 func InsertCache(settings *Settings, token *oauth2.Token) error {
-	if CacheLocation == "" {
+	if Cache == nil {
 		return nil
 	}
-	var cache, err = loadCache()
+	key := createKey(settings)
+	info := key.Info()
+	info.AuthType = settings.GetAuthType()
+	val, err := encodeCacheEntry(info, token, time.Now())
 	if err != nil {
 		return err
 	}
-	val, err := MarshalWithExtras(token, "")
+	if key.TokenExchange != nil {
+		// Exchanged tokens are keyed by their subject token, which changes
+		// whenever it is renewed, and cannot be refreshed. Prune the expired
+		// ones so that they do not accumulate in the cache.
+		if _, err := DeleteCacheEntries(isExpiredTokenExchange); err != nil {
+			return err
+		}
+	}
+	return Cache.Put(key.Digest(), val)
+}
+
+// Returns true if the entry holds an expired token obtained by token exchange.
+func isExpiredTokenExchange(entry CacheEntry) bool {
+	return entry.Key.TokenExchangeDigest != "" && isTokenExpired(entry.Token)
+}
+
+// Returns all entries in the cache, sorted by principal.
+func ListCache() ([]CacheEntry, error) {
+	if Cache == nil {
+		return nil, nil
+	}
+	cache, err := Cache.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	key, err := json.Marshal(createKey(settings))
+	var entries []CacheEntry
+	for digest, val := range cache {
+		entry, err := decodeCacheEntry(digest, val)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key.Principal != entries[j].Key.Principal {
+			return entries[i].Key.Principal < entries[j].Key.Principal
+		}
+		return entries[i].Digest < entries[j].Digest
+	})
+	return entries, nil
+}
+
+// Removes the entries for which match returns true from the cache.
+// Returns the number of removed entries.
+func DeleteCacheEntries(match func(entry CacheEntry) bool) (int, error) {
+	entries, err := ListCache()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	var digests []string
+	for _, entry := range entries {
+		if match(entry) {
+			digests = append(digests, entry.Digest)
+		}
+	}
+	if len(digests) == 0 {
+		return 0, nil
 	}
-	cache[string(key)] = val
-	data, err := json.Marshal(cache)
+	return len(digests), Cache.Delete(digests...)
+}
+
+// Encodes a value of the cache file. cachedAt is omitted if zero.
+func encodeCacheEntry(info CacheKeyInfo, token *oauth2.Token, cachedAt time.Time) ([]byte, error) {
+	data, err := MarshalWithExtras(token, "")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	v := cacheValueJSON{Key: info, Token: data}
+	if !cachedAt.IsZero() {
+		v.CachedAt = &cachedAt
 	}
-	return ioutil.WriteFile(CacheLocation, data, 0666)
+	return json.Marshal(v)
+}
+
+// Decodes a value of the cache file. Values written by previous versions
+// hold the token only.
+func decodeCacheEntry(digest string, val []byte) (*CacheEntry, error) {
+	var v cacheValueJSON
+	if err := json.Unmarshal(val, &v); err != nil {
+		return nil, err
+	}
+	if v.Token == nil {
+		v.Token = val
+	}
+	token, err := UnmarshalWithExtras(v.Token)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{Digest: digest, Key: v.Key, Token: token}
+	if v.CachedAt != nil {
+		entry.CachedAt = *v.CachedAt
+	}
+	return entry, nil
 }
 
 func ClearCache() error {
-	if CacheLocation == "" {
+	if Cache == nil {
 		return nil
 	}
-	if _, err := os.Stat(CacheLocation); os.IsNotExist(err) {
-		// Noop if file does not exist.
-		return nil
+	return Cache.Clear()
+}
+
+func createKey(settings *Settings) CacheKey {
+	key := CacheKey{
+		CredentialsJSON:          settings.CredentialsJSON,
+		Scope:                    settings.Scope,
+		Audience:                 settings.Audience,
+		Email:                    settings.Email,
+		APIKey:                   settings.APIKey,
+		QuotaProject:             settings.QuotaProject,
+		Sts:                      settings.Sts,
+		ServiceAccount:           settings.ServiceAccount,
+		Delegates:                settings.Delegates,
+		Lifetime:                 settings.ServiceAccountLifetime,
+		IDToken:                  settings.isIDTokenRequest(),
+		TokenExchange:            settings.TokenExchange,
+		AccessBoundary:           settings.AccessBoundary,
+		CIProvider:               settings.CIProvider,
+		WorkloadIdentityProvider: settings.WorkloadIdentityProvider,
+		Provider:                 settings.Provider,
+		JWT:                      settings.JWT,
+	}
+	if settings.GetAuthType() == AuthTypeMetadata {
+		key.MetadataHost = metadataHost()
 	}
-	return os.Remove(CacheLocation)
+	return key
 }
 
-func loadCache() (map[string][]byte, error) {
-	if _, err := os.Stat(CacheLocation); os.IsNotExist(err) {
-		// Create the cache file if not existing.
-		f, err := os.OpenFile(CacheLocation, os.O_RDONLY|os.O_CREATE, 0666)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-		f.Close()
+// The fields of a credentials file that identify the principal.
+// Other fields, such as the private key or redirect_uris, may change
+// without affecting which tokens can be obtained from the file.
+type credentialsIdentity struct {
+	Type         string `json:"type,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	ClientEmail  string `json:"client_email,omitempty"`
+	PrivateKeyID string `json:"private_key_id,omitempty"`
+	TokenURI     string `json:"token_uri,omitempty"`
+	// Distinguishes authorized_user credentials sharing the same client.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// The workload identity pool provider of external_account credentials.
+	Audience                       string `json:"audience,omitempty"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url,omitempty"`
+}
+
+// Extracts the identifying fields from a credentials file. For OAuth
+// Client ID files, the fields are read from the "installed" or "web" section.
+func getCredentialsIdentity(credentialsJSON string) credentialsIdentity {
+	var identity credentialsIdentity
+	if credentialsJSON == "" {
+		return identity
 	}
-	data, err := ioutil.ReadFile(CacheLocation)
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
+	var clientId struct {
+		Web       *credentialsIdentity `json:"web"`
+		Installed *credentialsIdentity `json:"installed"`
 	}
-	m := make(map[string][]byte)
-	if len(data) > 0 {
-		err = json.Unmarshal(data, &m)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
+	json.Unmarshal([]byte(credentialsJSON), &clientId)
+	if clientId.Web != nil {
+		return *clientId.Web
+	} else if clientId.Installed != nil {
+		return *clientId.Installed
+	}
+	json.Unmarshal([]byte(credentialsJSON), &identity)
+	return identity
+}
+
+// Info returns a description of the key that does not contain any secrets.
+func (key CacheKey) Info() CacheKeyInfo {
+	identity := getCredentialsIdentity(key.CredentialsJSON)
+	info := CacheKeyInfo{
+		CredentialType: identity.Type,
+		Principal:      identity.ClientEmail,
+		Scope:          normalizeScope(key.Scope),
+		Audience:       key.Audience,
+		Email:          key.Email,
+		QuotaProject:   key.QuotaProject,
+		Sts:            key.Sts,
+		ServiceAccount: key.ServiceAccount,
+		Delegates:      strings.Join(key.Delegates, ","),
+		IDToken:        key.IDToken,
+		AccessBoundary: key.AccessBoundary.String(),
+		JWTDigest:      key.JWT.Digest(),
+	}
+	if key.Lifetime != 0 {
+		info.Lifetime = key.Lifetime.String()
+	}
+	if key.MetadataHost != "" {
+		info.CredentialType = AuthTypeMetadata
+		info.Principal = key.MetadataHost
+	}
+	if key.CIProvider != "" {
+		info.CredentialType = key.CIProvider
+		info.Principal = key.WorkloadIdentityProvider
+	}
+	if key.Provider != nil {
+		info.CredentialType = AuthTypeProvider
+		info.Principal = key.Provider.ClientID
+		info.ProviderDigest = key.Provider.Digest()
+		info.RevocationURL = key.Provider.RevocationURL
+	} else if url := revokeURL(key.CredentialsJSON); url != GoogleRevokeURL {
+		info.RevocationURL = url
+	}
+	if key.TokenExchange != nil {
+		info.CredentialType = AuthTypeExchange
+		info.Principal = key.TokenExchange.Endpoint
+		info.Audience = strings.Join(key.TokenExchange.Audience, ",")
+		info.TokenExchangeDigest = key.TokenExchange.Digest()
+	}
+	if key.CredentialsJSON != "" {
+		info.CredentialsDigest = identity.Digest()
+		if info.CredentialType == "" {
+			info.CredentialType = clientIdCredentialType
 		}
 	}
-	return m, nil
+	if info.CredentialType == externalAccountKey {
+		info.Principal = identity.Audience
+	} else if info.Principal == "" {
+		info.Principal = identity.ClientID
+	}
+	return info
 }
 
-func createKey(settings *Settings) CacheKey {
-	// Removing redirect_uri from credentials file. This allows for dynamic
-	// localhost ports created during 3LO loopback.
-	var credentialsJSON string = settings.CredentialsJSON
-	re := regexp.MustCompile("\"redirect_uris\":([[:graph:]\\s]*?)\\]")
-	match := re.FindString(credentialsJSON)
-	credentialsJSON = strings.Replace(credentialsJSON, match, "\"redirect_uris\":[]", 1)
-
-	return CacheKey{
-		CredentialsJSON: credentialsJSON,
-		Scope:           settings.Scope,
-		Audience:        settings.Audience,
-		Email:           settings.Email,
-		APIKey:          settings.APIKey,
-		QuotaProject:    settings.QuotaProject,
-		Sts:             settings.Sts,
-		ServiceAccount:  settings.ServiceAccount,
+// Digest returns a SHA-256 based identifier of the identifying fields.
+func (identity credentialsIdentity) Digest() string {
+	data, _ := json.Marshal(identity)
+	sum := sha256.Sum256(data)
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// Digest returns a stable SHA-256 based identifier of the key, computed
+// from the normalized key fields. The digest is used as the key in the
+// cache file, so that no credentials are stored in the cache.
+func (key CacheKey) Digest() string {
+	data, _ := json.Marshal(struct {
+		Credentials              credentialsIdentity `json:"credentials"`
+		Scope                    string              `json:"scope,omitempty"`
+		Audience                 string              `json:"audience,omitempty"`
+		Email                    string              `json:"email,omitempty"`
+		APIKey                   string              `json:"api_key,omitempty"`
+		QuotaProject             string              `json:"quota_project,omitempty"`
+		Sts                      bool                `json:"sts,omitempty"`
+		ServiceAccount           string              `json:"service_account,omitempty"`
+		Delegates                []string            `json:"delegates,omitempty"`
+		Lifetime                 time.Duration       `json:"lifetime,omitempty"`
+		IDToken                  bool                `json:"id_token,omitempty"`
+		TokenExchange            string              `json:"token_exchange,omitempty"`
+		AccessBoundary           *AccessBoundary     `json:"access_boundary,omitempty"`
+		CIProvider               string              `json:"ci_provider,omitempty"`
+		WorkloadIdentityProvider string              `json:"workload_identity_provider,omitempty"`
+		MetadataHost             string              `json:"metadata_host,omitempty"`
+		Provider                 string              `json:"provider,omitempty"`
+		JWT                      string              `json:"jwt,omitempty"`
+	}{
+		Credentials:              getCredentialsIdentity(key.CredentialsJSON),
+		Scope:                    normalizeScope(key.Scope),
+		Audience:                 key.Audience,
+		Email:                    key.Email,
+		APIKey:                   key.APIKey,
+		QuotaProject:             key.QuotaProject,
+		Sts:                      key.Sts,
+		ServiceAccount:           key.ServiceAccount,
+		Delegates:                key.Delegates,
+		Lifetime:                 key.Lifetime,
+		IDToken:                  key.IDToken,
+		TokenExchange:            key.TokenExchange.Digest(),
+		AccessBoundary:           key.AccessBoundary,
+		CIProvider:               key.CIProvider,
+		WorkloadIdentityProvider: key.WorkloadIdentityProvider,
+		MetadataHost:             key.MetadataHost,
+		Provider:                 key.Provider.Digest(),
+		JWT:                      key.JWT.Digest(),
+	})
+	sum := sha256.Sum256(data)
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// Digest returns a SHA-256 based identifier of the token exchange parameters,
+// excluding the scopes which are part of the cache key. Returns an empty
+// string for nil.
+func (request *TokenExchangeRequest) Digest() string {
+	if request == nil {
+		return ""
+	}
+	params := *request // Make a shallow copy
+	params.Scope = ""
+	data, _ := json.Marshal(params)
+	sum := sha256.Sum256(data)
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// Replaces the JSON encoded CacheKeys used as keys by previous versions
+// with their digests. Returns true if any key was migrated.
+func migrateLegacyKeys(cache map[string][]byte) bool {
+	migrated := false
+	for k, v := range cache {
+		if strings.HasPrefix(k, cacheKeyDigestPrefix) {
+			continue
+		}
+		delete(cache, k)
+		migrated = true
+		var legacyKey CacheKey
+		if err := json.Unmarshal([]byte(k), &legacyKey); err != nil {
+			// Drop entries that cannot be attributed to any key.
+			continue
+		}
+		digest := legacyKey.Digest()
+		if _, ok := cache[digest]; ok {
+			continue
+		}
+		if token, err := UnmarshalWithExtras(v); err == nil {
+			if val, err := encodeCacheEntry(legacyKey.Info(), token, time.Time{}); err == nil {
+				cache[digest] = val
+			}
+		}
 	}
+	return migrated
 }
 
 func GuessUnixHomeDir() string {
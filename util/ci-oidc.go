@@ -0,0 +1,162 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// ci-oidc implements keyless Workload Identity Federation for CI jobs,
+// using the OIDC token issued to the job as subject token.
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Supported CI providers.
+const (
+	CIProviderGitHub = "github"
+	CIProviderGitLab = "gitlab"
+)
+
+// Prefix of the full resource names of IAM resources.
+const iamResourcePrefix = "//iam.googleapis.com/"
+
+// Environment variables holding the GitLab ID token, in order of precedence.
+// GITLAB_OIDC_TOKEN is the conventional name of an ID token declared with
+// the id_tokens keyword. CI_JOB_JWT_V2 and CI_JOB_JWT are deprecated.
+var gitLabTokenEnvVars = []string{"GITLAB_OIDC_TOKEN", "CI_JOB_JWT_V2", "CI_JOB_JWT"}
+
+// ciOIDCTokenSource exchanges the OIDC token of the CI job for a federated
+// access token at STS.
+type ciOIDCTokenSource struct {
+	ciProvider string
+	// Full resource name of the Workload Identity Provider.
+	audience string
+	scope    string
+	endpoint string
+}
+
+// CIOIDCTokenSource returns a token source exchanging the OIDC token of the
+// CI job for a federated access token of the Workload Identity Provider.
+// If a Service Account is impersonated, the federated token is requested
+// with the cloud-platform scope required by IAM.
+func CIOIDCTokenSource(settings *Settings) (oauth2.TokenSource, error) {
+	provider := strings.TrimPrefix(settings.WorkloadIdentityProvider, iamResourcePrefix)
+	if provider == "" {
+		return nil, errors.New("Workload Identity Provider is required for CI OIDC tokens")
+	}
+	scope := settings.Scope
+	if settings.ServiceAccount != "" {
+		scope = iamScope
+	}
+	endpoint := settings.StsEndpoint
+	if endpoint == "" {
+		endpoint = GoogleStsTokenURL
+	}
+	return ciOIDCTokenSource{
+		ciProvider: settings.CIProvider,
+		audience:   iamResourcePrefix + provider,
+		scope:      scope,
+		endpoint:   endpoint,
+	}, nil
+}
+
+func (s ciOIDCTokenSource) Token() (*oauth2.Token, error) {
+	// GitHub issues ID tokens for any audience. By convention, the provider is
+	// addressed by its HTTPS URL, which is the default allowed audience.
+	subjectToken, err := fetchCIOIDCToken(s.ciProvider, "https:"+s.audience)
+	if err != nil {
+		return nil, err
+	}
+	return ExchangeToken(&TokenExchangeRequest{
+		Endpoint:           s.endpoint,
+		SubjectToken:       subjectToken,
+		SubjectTokenType:   TokenTypeJWT,
+		Audience:           []string{s.audience},
+		RequestedTokenType: TokenTypeAccessToken,
+		Scope:              s.scope,
+	})
+}
+
+// Returns the OIDC token of the CI job. The audience is only requested from
+// GitHub, since GitLab ID tokens are issued with the audience configured
+// in the pipeline.
+func fetchCIOIDCToken(ciProvider string, audience string) (string, error) {
+	switch ciProvider {
+	case CIProviderGitHub:
+		return fetchGitHubOIDCToken(audience)
+	case CIProviderGitLab:
+		for _, name := range gitLabTokenEnvVars {
+			if token := strings.TrimSpace(os.Getenv(name)); token != "" {
+				return token, nil
+			}
+		}
+		return "", fmt.Errorf("No GitLab ID token found. Declare an ID token named %s with the id_tokens keyword.",
+			gitLabTokenEnvVars[0])
+	}
+	return "", fmt.Errorf("Unsupported CI provider: %s", ciProvider)
+}
+
+// Requests an ID token for the audience from the GitHub Actions runtime.
+func fetchGitHubOIDCToken(audience string) (string, error) {
+	requestURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestURL == "" || requestToken == "" {
+		return "", errors.New("ACTIONS_ID_TOKEN_REQUEST_URL and ACTIONS_ID_TOKEN_REQUEST_TOKEN are not set. " +
+			"Grant the workflow the id-token: write permission.")
+	}
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("audience", audience)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+requestToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if code := resp.StatusCode; code < 200 || code > 299 {
+		return "", fmt.Errorf("Failed to obtain GitHub ID token: %s", body)
+	}
+	var res struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return "", err
+	}
+	if res.Value == "" {
+		return "", errors.New("Failed to obtain GitHub ID token: empty response")
+	}
+	return res.Value, nil
+}
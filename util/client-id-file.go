@@ -18,9 +18,22 @@
 package util
 
 import (
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
+// clientIdJSON is the struct representing the content of an OAuth Client ID file.
+type clientIdJSON struct {
+	ClientID      string `json:"client_id"`
+	ClientSecret  string `json:"client_secret"`
+	AuthURI       string `json:"auth_uri"`
+	TokenURI      string `json:"token_uri"`
+	DeviceAuthURI string `json:"device_auth_uri"`
+}
+
 // IsValidOauthClientIdFile determines if a valid OAuth Client ID file can be created
 // from a credentials json file.
 //
@@ -52,3 +65,46 @@ func GetFirstRedirectURI(credentialsJSON string) (firstRedirectURI string, err e
 
 	return credentials.RedirectURL, nil
 }
+
+// clientConfigFromJSON is similar to google.ConfigFromJSON, except that
+// "redirect_uris" are optional. OAuth Client IDs of type "TVs and Limited
+// Input devices" do not have any.
+//
+// The device authorization endpoint defaults to Google's, and can be
+// overridden with "device_auth_uri".
+func clientConfigFromJSON(credentialsJSON string, scope ...string) (*oauth2.Config, error) {
+	var j struct {
+		Web       *clientIdJSON `json:"web"`
+		Installed *clientIdJSON `json:"installed"`
+	}
+	if err := json.Unmarshal([]byte(credentialsJSON), &j); err != nil {
+		return nil, err
+	}
+	c := j.Installed
+	if j.Web != nil {
+		c = j.Web
+	}
+	if c == nil {
+		return nil, errors.New("no OAuth Client ID found in credentials")
+	}
+	endpoint := google.Endpoint
+	if c.AuthURI != "" {
+		endpoint.AuthURL = c.AuthURI
+	}
+	if c.TokenURI != "" {
+		endpoint.TokenURL = c.TokenURI
+	}
+	if c.DeviceAuthURI != "" {
+		endpoint.DeviceAuthURL = c.DeviceAuthURI
+	}
+	config := &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		Scopes:       scope,
+		Endpoint:     endpoint,
+	}
+	if redirectURI, err := GetFirstRedirectURI(credentialsJSON); err == nil {
+		config.RedirectURL = redirectURI
+	}
+	return config, nil
+}
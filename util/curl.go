@@ -25,11 +25,15 @@ const (
 )
 
 // Executes curl command with provided header and params.
+// No header is sent if header is empty.
 func CurlCommand(cli string, header string, url string, extraArgs ...string) {
 	if cli == "" {
 		cli = defaultCurlCli
 	}
-	requiredArgs := []string{"-H", header, url}
+	requiredArgs := []string{url}
+	if header != "" {
+		requiredArgs = []string{"-H", header, url}
+	}
 	cmdArgs := append(requiredArgs, extraArgs...)
 
 	cmd := exec.Command(cli, cmdArgs...)
@@ -0,0 +1,72 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// device implements the OAuth 2.0 Device Authorization Grant (RFC 8628),
+// which allows 3LO on machines without a browser.
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// deviceTokenSource implements oauth2.TokenSource. Each call to Token
+// starts a new device authorization and polls the token endpoint until
+// the user approves or denies the request, or the device code expires.
+type deviceTokenSource struct {
+	ctx    context.Context
+	config *oauth2.Config
+}
+
+func (ts deviceTokenSource) Token() (*oauth2.Token, error) {
+	da, err := ts.config.DeviceAuth(ts.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Device authorization failed: %v", err)
+	}
+	verificationURI := da.VerificationURIComplete
+	if verificationURI == "" {
+		verificationURI = da.VerificationURI
+	}
+	fmt.Printf("Go to the following link in your browser:\n\n   %s\n\n", verificationURI)
+	fmt.Printf("Enter the following code when prompted:\n\n   %s\n\n", da.UserCode)
+
+	// DeviceAccessToken honors the polling interval, slow_down responses
+	// and the expiry of the device code.
+	token, err := ts.config.DeviceAccessToken(ts.ctx, da)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, errors.New("Device code expired before authorization was granted")
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+// DeviceCredentialsFromJSON builds credentials from an OAuth Client ID file
+// whose token source performs the device authorization flow.
+func DeviceCredentialsFromJSON(ctx context.Context, credentialsJSON string, scopes []string) (*google.Credentials, error) {
+	config, err := clientConfigFromJSON(credentialsJSON, scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Device flow requires an OAuth Client ID file: %v", err)
+	}
+	return &google.Credentials{
+		TokenSource: deviceTokenSource{ctx: ctx, config: config},
+		JSON:        []byte(credentialsJSON),
+	}, nil
+}
@@ -0,0 +1,154 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// discovery implements OpenID Connect Discovery, which provides the
+// endpoints of a provider from its issuer URL.
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Path of the discovery document relative to the issuer URL.
+const discoveryPath = "/.well-known/openid-configuration"
+
+// Suffix of the file or directory caching discovery documents, which is
+// appended to the path of the token cache.
+const discoveryCacheSuffix = "-discovery"
+
+// Cached discovery documents are fetched again once they are older than this.
+const discoveryCacheTTL = 24 * time.Hour
+
+// Caches discovery documents while the token cache is in memory.
+var memoryDiscoveryCache = NewMemoryCacheStore()
+
+// DiscoveryDocument holds the provider metadata used by oauth2l.
+type DiscoveryDocument struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint                 string   `json:"token_endpoint,omitempty"`
+	UserinfoEndpoint              string   `json:"userinfo_endpoint,omitempty"`
+	RevocationEndpoint            string   `json:"revocation_endpoint,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+}
+
+// The format of the values in the discovery cache, keyed by the digest of
+// the issuer.
+type discoveryCacheEntry struct {
+	Document  *DiscoveryDocument `json:"document"`
+	FetchedAt time.Time          `json:"fetched_at"`
+}
+
+// Discover returns the discovery document of the given issuer, from the
+// discovery cache if it has been fetched recently.
+func Discover(issuer string) (*DiscoveryDocument, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	cache := discoveryCache()
+	digest := discoveryCacheDigest(issuer)
+	if cache != nil {
+		var entry discoveryCacheEntry
+		if val, err := cache.Get(digest); err == nil && json.Unmarshal(val, &entry) == nil &&
+			entry.Document != nil && time.Since(entry.FetchedAt) < discoveryCacheTTL {
+			return entry.Document, nil
+		}
+	}
+	doc, err := fetchDiscoveryDocument(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		// Caching is best effort. The document is fetched again next time.
+		if val, err := json.Marshal(discoveryCacheEntry{Document: doc, FetchedAt: time.Now()}); err == nil {
+			cache.Put(digest, val)
+		}
+	}
+	return doc, nil
+}
+
+func fetchDiscoveryDocument(issuer string) (*DiscoveryDocument, error) {
+	resp, err := http.Get(issuer + discoveryPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch discovery document of %s: %v", issuer, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch discovery document of %s: %s", issuer, resp.Status)
+	}
+	var doc DiscoveryDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("Failed to parse discovery document of %s: %v", issuer, err)
+	}
+	// The issuer must match exactly, so that a provider cannot claim
+	// endpoints on behalf of another issuer.
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("Discovery document of %s is for a different issuer: %s", issuer, doc.Issuer)
+	}
+	return &doc, nil
+}
+
+// Returns the store caching discovery documents next to the token cache,
+// or nil if caching is disabled or the token cache is a custom store.
+func discoveryCache() CacheStore {
+	switch store := Cache.(type) {
+	case locationCacheStore:
+		if CacheLocation == "" {
+			return nil
+		}
+		return NewFileCacheStore(CacheLocation + discoveryCacheSuffix)
+	case *fileCacheStore:
+		return NewFileCacheStore(store.path + discoveryCacheSuffix)
+	case *dirCacheStore:
+		return NewDirCacheStore(store.dir + discoveryCacheSuffix)
+	case *memoryCacheStore:
+		return memoryDiscoveryCache
+	}
+	return nil
+}
+
+// Returns the key of the discovery document of the issuer in the cache.
+func discoveryCacheDigest(issuer string) string {
+	sum := sha256.Sum256([]byte(issuer))
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// Returns an error if the issuer does not support the given grant type,
+// or PKCE for the authorization code flow. Grant types are only checked
+// if the issuer lists them.
+func (doc *DiscoveryDocument) checkSupport(grantType string) error {
+	if len(doc.GrantTypesSupported) > 0 && !containsString(doc.GrantTypesSupported, grantType) {
+		return fmt.Errorf("Issuer %s does not support the %s grant. Supported grants: %s",
+			doc.Issuer, grantType, strings.Join(doc.GrantTypesSupported, ", "))
+	}
+	if grantType == GrantTypeAuthorizationCode && !containsString(doc.CodeChallengeMethodsSupported, "S256") {
+		supported := strings.Join(doc.CodeChallengeMethodsSupported, ", ")
+		if supported == "" {
+			supported = "none"
+		}
+		return fmt.Errorf("Issuer %s does not support PKCE with S256. Supported methods: %s", doc.Issuer, supported)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// external-account implements helpers for Workload and Workforce Identity
+// Federation credentials of type external_account. Subject tokens are
+// obtained and exchanged by golang.org/x/oauth2/google.
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Environment variable that allows external_account credentials to run
+// executables for obtaining subject tokens.
+const allowExecutablesEnvVar = "GOOGLE_EXTERNAL_ACCOUNT_ALLOW_EXECUTABLES"
+
+var (
+	// Matches the audience of workload and workforce identity pool providers.
+	identityPoolProviderPattern = regexp.MustCompile(`/(?:workloadIdentityPools|workforcePools)/([^/]+)/providers/([^/]+)$`)
+	// Matches the Service Account of an impersonation URL.
+	impersonationURLPattern = regexp.MustCompile(`/serviceAccounts/([^/:]+):generateAccessToken$`)
+)
+
+// externalAccountInfo describes external_account credentials.
+type externalAccountInfo struct {
+	Pool           string
+	Provider       string
+	ServiceAccount string
+	// One of "file", "url", "executable" or "aws".
+	CredentialSource string
+}
+
+// AllowExecutables allows external_account credentials with executable
+// sources to run their command for obtaining subject tokens.
+func AllowExecutables() {
+	os.Setenv(allowExecutablesEnvVar, "1")
+}
+
+// Adds a hint to the error returned if the executable of the credentials
+// is not allowed to run.
+func explainExecutablesError(err error) error {
+	if err != nil && strings.Contains(err.Error(), allowExecutablesEnvVar) {
+		return fmt.Errorf("%v\nUse --allow-executables to allow the credentials to run their executable.", err)
+	}
+	return err
+}
+
+// Extracts the identity pool, provider, impersonated Service Account and
+// credential source type from external_account credentials.
+func getExternalAccountInfo(credentialsJSON []byte) externalAccountInfo {
+	var config struct {
+		Audience                       string `json:"audience"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+		CredentialSource               struct {
+			File          string          `json:"file"`
+			URL           string          `json:"url"`
+			Executable    json.RawMessage `json:"executable"`
+			EnvironmentID string          `json:"environment_id"`
+		} `json:"credential_source"`
+	}
+	json.Unmarshal(credentialsJSON, &config)
+
+	var info externalAccountInfo
+	if m := identityPoolProviderPattern.FindStringSubmatch(config.Audience); m != nil {
+		info.Pool, info.Provider = m[1], m[2]
+	}
+	if m := impersonationURLPattern.FindStringSubmatch(config.ServiceAccountImpersonationURL); m != nil {
+		info.ServiceAccount = m[1]
+	}
+	source := config.CredentialSource
+	switch {
+	case source.File != "":
+		info.CredentialSource = "file"
+	case source.URL != "":
+		info.CredentialSource = "url"
+	case source.Executable != nil:
+		info.CredentialSource = "executable"
+	case source.EnvironmentID != "":
+		info.CredentialSource = "aws"
+	}
+	return info
+}
@@ -35,10 +35,20 @@ func newTokenSource(ctx context.Context, settings *Settings) (*oauth2.TokenSourc
 		ts, err = google.DefaultTokenSource(ctx, DefaultScope)
 	} else if settings.GetAuthType() == AuthTypeAPIKey {
 		return nil, nil
-	} else if settings.GetAuthType() == AuthTypeOAuth {
+	} else if settings.GetAuthType() == AuthTypeOAuth || settings.GetAuthType() == AuthTypeDevice {
 		ts, err = OAuthJSONTokenSource(ctx, settings)
 	} else if settings.GetAuthType() == AuthTypeJWT {
 		ts, err = JWTTokenSource(ctx, settings)
+	} else if settings.GetAuthType() == AuthTypeIDToken {
+		ts, err = IDTokenSource(ctx, settings)
+	} else if settings.GetAuthType() == AuthTypeExchange {
+		ts, err = ExchangeTokenSource(settings)
+	} else if settings.GetAuthType() == AuthTypeCIOIDC {
+		ts, err = CIOIDCTokenSource(settings)
+	} else if settings.GetAuthType() == AuthTypeMetadata {
+		ts, err = MetadataTokenSource(ctx, settings)
+	} else if settings.GetAuthType() == AuthTypeProvider {
+		ts, err = ProviderTokenSource(ctx, settings)
 	} else {
 		return nil, fmt.Errorf("Unsupported authentcation method: %s", settings.GetAuthType())
 	}
@@ -61,7 +71,7 @@ func FetchToken(ctx context.Context, settings *Settings) (*oauth2.Token, error)
 	ts := oauth2.ReuseTokenSource(nil, *src)
 	t, err := ts.Token()
 	if err != nil {
-		return nil, err
+		return nil, explainExecutablesError(err)
 	}
 	return t, nil
 }
@@ -76,11 +86,16 @@ func OAuthJSONTokenSource(ctx context.Context, settings *Settings) (oauth2.Token
 }
 
 func JWTTokenSource(ctx context.Context, settings *Settings) (oauth2.TokenSource, error) {
+	if settings.JWT != nil && settings.JWT.SigningKey != nil {
+		return customJWTTokenSource(nil, settings)
+	}
 	creds, err := FindJSONCredentials(ctx, settings)
 	if err != nil {
 		return nil, err
 	}
-	if settings.Audience != "" {
+	if settings.JWT.isCustom() {
+		return customJWTTokenSource(creds.JSON, settings)
+	} else if settings.Audience != "" {
 		return google.JWTAccessTokenSourceFromJSON(creds.JSON, settings.Audience)
 	} else if settings.Scope != "" {
 		return google.JWTAccessTokenSourceWithScope(creds.JSON, settings.Scope)
@@ -97,7 +112,9 @@ func FindJSONCredentials(ctx context.Context, settings *Settings) (*google.Crede
 	params.AuthHandler = settings.AuthHandler
 	params.Subject = settings.Email
 	params.PKCE = GeneratePKCEParams()
-	if settings.CredentialsJSON != "" {
+	if settings.GetAuthType() == AuthTypeDevice {
+		return DeviceCredentialsFromJSON(ctx, settings.CredentialsJSON, params.Scopes)
+	} else if settings.CredentialsJSON != "" {
 		return google.CredentialsFromJSONWithParams(ctx, []byte(settings.CredentialsJSON),
 			params)
 
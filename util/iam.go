@@ -15,42 +15,185 @@
 package util
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
 	"golang.org/x/oauth2"
 )
 
+// The default base URL of the IAM Service Account Credentials API.
+const defaultIamEndpoint = "https://iamcredentials.googleapis.com"
+
+// IamEndpoint is the base URL of the IAM Service Account Credentials API,
+// which replaces the host of the IAM URLs below. It can be changed to use
+// a private endpoint.
+var IamEndpoint = defaultIamEndpoint
+
 // IamServiceAccountAccessTokenURL is used for generating accesss token for a Service Account.
 const IamServiceAccountAccessTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken"
 
+// IamServiceAccountSignBlobURL is used for signing bytes with a Google-managed
+// key of a Service Account.
+const IamServiceAccountSignBlobURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:signBlob"
+
+// IamServiceAccountSignJwtURL is used for signing JWTs with a Google-managed
+// key of a Service Account.
+const IamServiceAccountSignJwtURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:signJwt"
+
 // iamTokenJSON is the struct representing the HTTP response from IAM
 type iamTokenJSON struct {
 	AccessToken string `json:"accessToken"`
 	ExpireTime  string `json:"expireTime"`
 }
 
+// iamErrorJSON is the struct representing an error response from IAM
+type iamErrorJSON struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// ImpersonationOptions are the optional parameters of the access tokens
+// generated for a Service Account.
+type ImpersonationOptions struct {
+	// The delegation chain. Each Service Account in the chain must be allowed
+	// to impersonate the next one, ending with the impersonated one.
+	Delegates []string
+	// The lifetime of the access token. Defaults to one hour if zero.
+	Lifetime time.Duration
+}
+
 // GenerateServiceAccountAccessToken generates a Service Account access token using a User access
 // token approved for at least one of the following scopes:
 // * https://www.googleapis.com/auth/iam
 // * https://www.googleapis.com/auth/cloud-platform
 func GenerateServiceAccountAccessToken(accessToken string, serviceAccount string, scope string) (*oauth2.Token, error) {
-	form := url.Values{}
-	for _, s := range strings.Split(scope, " ") {
-		form.Add("scope", s)
+	return GenerateServiceAccountAccessTokenWithOptions(accessToken, serviceAccount, scope, ImpersonationOptions{})
+}
+
+// GenerateServiceAccountAccessTokenWithOptions is like
+// GenerateServiceAccountAccessToken, with a delegation chain and lifetime.
+func GenerateServiceAccountAccessTokenWithOptions(accessToken string, serviceAccount string, scope string,
+	options ImpersonationOptions) (*oauth2.Token, error) {
+	reqBody := map[string]interface{}{
+		"scope": strings.Fields(scope),
+	}
+	if len(options.Delegates) > 0 {
+		reqBody["delegates"] = delegateNames(options.Delegates)
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf(IamServiceAccountAccessTokenURL, serviceAccount), strings.NewReader(form.Encode()))
+	if options.Lifetime > 0 {
+		reqBody["lifetime"] = fmt.Sprintf("%ds", int64(options.Lifetime.Seconds()))
+	}
+	body, err := iamRequest(iamURL(IamServiceAccountAccessTokenURL, serviceAccount), accessToken, reqBody)
 	if err != nil {
+		return nil, fmt.Errorf("Failed to generate access token for Service Account %s: %v", serviceAccount, err)
+	}
+
+	var itj iamTokenJSON
+	if err = json.Unmarshal(body, &itj); err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token := oauth2.Token{}
+	token.AccessToken = itj.AccessToken
+	token.Expiry, _ = time.Parse(time.RFC3339, itj.ExpireTime)
+	var raw map[string]interface{}
+	json.Unmarshal(body, &raw)
+	return token.WithExtra(raw), nil
+}
+
+// SignServiceAccountBlob signs the payload with a Google-managed key of the
+// Service Account, using a User access token approved for the cloud-platform
+// scope. The signature is RSA SHA-256.
+func SignServiceAccountBlob(accessToken string, serviceAccount string, payload []byte,
+	delegates []string) (*Signature, error) {
+	reqBody := map[string]interface{}{
+		"payload": base64.StdEncoding.EncodeToString(payload),
+	}
+	if len(delegates) > 0 {
+		reqBody["delegates"] = delegateNames(delegates)
+	}
+	body, err := iamRequest(iamURL(IamServiceAccountSignBlobURL, serviceAccount), accessToken, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign blob for Service Account %s: %v", serviceAccount, err)
+	}
+	var res struct {
+		KeyID      string `json:"keyId"`
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return &Signature{KeyID: res.KeyID, Signature: res.SignedBlob}, nil
+}
+
+// SignServiceAccountJWT signs the JSON encoded claims as JWT with a
+// Google-managed key of the Service Account, using a User access token
+// approved for the cloud-platform scope. IAM sets the header of the JWT.
+func SignServiceAccountJWT(accessToken string, serviceAccount string, claims []byte,
+	delegates []string) (*Signature, error) {
+	reqBody := map[string]interface{}{
+		"payload": string(claims),
+	}
+	if len(delegates) > 0 {
+		reqBody["delegates"] = delegateNames(delegates)
+	}
+	body, err := iamRequest(iamURL(IamServiceAccountSignJwtURL, serviceAccount), accessToken, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign JWT for Service Account %s: %v", serviceAccount, err)
+	}
+	var res struct {
+		KeyID     string `json:"keyId"`
+		SignedJwt string `json:"signedJwt"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return &Signature{KeyID: res.KeyID, SignedJWT: res.SignedJwt}, nil
+}
+
+// Returns the resource names of the given delegate Service Accounts, which
+// may be given as emails or unique IDs.
+func delegateNames(delegates []string) []string {
+	names := make([]string, len(delegates))
+	for i, delegate := range delegates {
+		if strings.Contains(delegate, "/") {
+			names[i] = delegate
+		} else {
+			names[i] = "projects/-/serviceAccounts/" + delegate
+		}
+	}
+	return names
+}
+
+// Returns the URL of the IAM method for the Service Account, with the host
+// replaced by IamEndpoint.
+func iamURL(urlFormat string, serviceAccount string) string {
+	path := strings.TrimPrefix(fmt.Sprintf(urlFormat, serviceAccount), defaultIamEndpoint)
+	return strings.TrimSuffix(IamEndpoint, "/") + path
+}
+
+// Sends the JSON encoded request to the given IAM Credentials URL on behalf of
+// the owner of the access token, and returns the response body.
+func iamRequest(url string, accessToken string, reqBody interface{}) ([]byte, error) {
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 	client := http.DefaultClient
 	resp, err := client.Do(req)
@@ -60,20 +203,25 @@ func GenerateServiceAccountAccessToken(accessToken string, serviceAccount string
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
 	if err != nil {
-		return nil, fmt.Errorf("oauth2l: GenerateServiceAccountAccessToken failed: %v", err)
+		return nil, err
 	}
 	if code := resp.StatusCode; code < 200 || code > 299 {
-		return nil, errors.New(string(body))
+		return nil, iamError(body)
 	}
+	return body, nil
+}
 
-	var itj iamTokenJSON
-	if err = json.Unmarshal(body, &itj); err != nil {
-		return nil, err
+// Returns a readable error from an IAM error response. Falls back to the
+// response body if it cannot be parsed.
+func iamError(body []byte) error {
+	var iej iamErrorJSON
+	if err := json.Unmarshal(body, &iej); err != nil || iej.Error.Message == "" {
+		return errors.New(string(body))
 	}
-	token := oauth2.Token{}
-	token.AccessToken = itj.AccessToken
-	token.Expiry, _ = time.Parse(time.RFC3339, itj.ExpireTime)
-	var raw map[string]interface{}
-	json.Unmarshal(body, &raw)
-	return token.WithExtra(raw), nil
+	msg := fmt.Sprintf("%s (%d %s)", iej.Error.Message, iej.Error.Code, iej.Error.Status)
+	if iej.Error.Status == "PERMISSION_DENIED" {
+		msg += "\nThe caller needs the Service Account Token Creator role (roles/iam.serviceAccountTokenCreator) " +
+			"on the Service Account, and each delegate needs it on the next Service Account in the chain."
+	}
+	return errors.New(msg)
 }
@@ -0,0 +1,133 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// idtoken implements fetching of OpenID Connect ID tokens, which are used
+// to call services such as Cloud Run, Cloud Functions and IAP.
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+// IamServiceAccountIdTokenURL is used for generating ID tokens for a Service Account.
+const IamServiceAccountIdTokenURL = "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateIdToken"
+
+// Scopes requested for user credentials, so that the token endpoint
+// returns an ID token along with the access token.
+const idTokenUserScope = "openid https://www.googleapis.com/auth/userinfo.email"
+
+// Scope of the access token used to call IAM on behalf of the user.
+const iamScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// IDTokenSource returns a token source whose tokens carry an ID token for
+// settings.Audience as access token.
+//
+// For Service Account keys, a JWT with the audience as "target_audience" is
+// exchanged for an ID token. For user credentials, the ID token issued along
+// with the access token is returned. Its audience is always the OAuth client.
+func IDTokenSource(ctx context.Context, settings *Settings) (oauth2.TokenSource, error) {
+	if settings.Audience == "" {
+		return nil, errors.New("Audience is required for ID tokens")
+	}
+	credentialType := getCredentialsIdentity(settings.CredentialsJSON).Type
+	if credentialType == serviceAccountKey {
+		config, err := google.JWTConfigFromJSON([]byte(settings.CredentialsJSON))
+		if err != nil {
+			return nil, err
+		}
+		config.PrivateClaims = map[string]interface{}{"target_audience": settings.Audience}
+		config.UseIDToken = true
+		return config.TokenSource(ctx), nil
+	}
+	if settings.CredentialsJSON != "" && credentialType != userCredentialsKey {
+		if _, err := clientConfigFromJSON(settings.CredentialsJSON); err != nil {
+			return nil, fmt.Errorf("ID tokens are not supported for credentials of type %s", credentialType)
+		}
+	}
+	userSettings := *settings // Make a shallow copy
+	userSettings.AuthType = AuthTypeOAuth
+	userSettings.Scope = idTokenUserScope
+	ts, err := OAuthJSONTokenSource(ctx, &userSettings)
+	if err != nil {
+		return nil, err
+	}
+	return userIDTokenSource{ts}, nil
+}
+
+// userIDTokenSource returns the ID token issued along with the tokens of
+// the wrapped token source.
+type userIDTokenSource struct {
+	ts oauth2.TokenSource
+}
+
+func (s userIDTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, errors.New("No ID token was returned. Authorize with the openid scope and try again.")
+	}
+	return newIDToken(idToken, token.RefreshToken)
+}
+
+// Returns a token holding the given ID token as access token, and
+// expiring when the ID token expires.
+func newIDToken(idToken string, refreshToken string) (*oauth2.Token, error) {
+	claims, err := jws.Decode(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode ID token: %v", err)
+	}
+	token := &oauth2.Token{
+		AccessToken:  idToken,
+		TokenType:    "Bearer",
+		RefreshToken: refreshToken,
+		Expiry:       time.Unix(claims.Exp, 0),
+	}
+	return token.WithExtra(map[string]interface{}{"id_token": idToken}), nil
+}
+
+// GenerateServiceAccountIdToken generates a Service Account ID token for the given
+// audience using a User access token approved for the cloud-platform scope.
+func GenerateServiceAccountIdToken(accessToken string, serviceAccount string, audience string,
+	delegates []string) (*oauth2.Token, error) {
+	reqBody := map[string]interface{}{
+		"audience":     audience,
+		"includeEmail": true,
+	}
+	if len(delegates) > 0 {
+		reqBody["delegates"] = delegateNames(delegates)
+	}
+	body, err := iamRequest(iamURL(IamServiceAccountIdTokenURL, serviceAccount), accessToken, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate ID token for Service Account %s: %v", serviceAccount, err)
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return newIDToken(res.Token, "")
+}
@@ -0,0 +1,279 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// jwt implements self-signed JWTs with custom claims, as accepted by
+// Cloud Endpoints and ESPv2 backends, signed with Service Account keys or
+// arbitrary signing keys.
+package util
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Lifetime of self-signed JWTs if none is specified.
+const defaultJWTLifetime = time.Hour
+
+// JWTSettings customizes the claims of self-signed JWTs.
+type JWTSettings struct {
+	// The "iss" claim. Defaults to the Service Account email.
+	Issuer string `json:"issuer,omitempty"`
+	// The "sub" claim. Defaults to the Service Account email.
+	Subject string `json:"subject,omitempty"`
+	// The time between the "iat" and "exp" claims. Defaults to 1h.
+	Lifetime time.Duration `json:"lifetime,omitempty"`
+	// Additional claims, which take precedence over the claims above.
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	// The key used instead of the Service Account key, if any.
+	SigningKey *SigningKey `json:"-"`
+	// The signing algorithm. Defaults to one matching the key.
+	Algorithm string `json:"algorithm,omitempty"`
+	// The "kid" header. Defaults to the ID of the key.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// Returns true if the settings customize any claim or the signature.
+func (s *JWTSettings) isCustom() bool {
+	return s != nil && (s.Issuer != "" || s.Subject != "" || s.Lifetime != 0 || len(s.Claims) > 0 ||
+		s.SigningKey != nil || s.Algorithm != "" || s.KeyID != "")
+}
+
+// Digest returns a SHA-256 based identifier of the settings. Returns an
+// empty string if neither the claims nor the signature are customized.
+//
+// Signing keys are identified by their public key.
+func (s *JWTSettings) Digest() string {
+	if !s.isCustom() {
+		return ""
+	}
+	digest := struct {
+		*JWTSettings
+		PublicKey []byte `json:"public_key,omitempty"`
+	}{JWTSettings: s}
+	if s.SigningKey != nil {
+		digest.PublicKey, _ = x509.MarshalPKIXPublicKey(s.SigningKey.Signer.Public())
+	}
+	data, _ := json.Marshal(digest)
+	sum := sha256.Sum256(data)
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// jwtSigner signs JWTs with a signing key or the key of a Service Account.
+type jwtSigner struct {
+	key   crypto.Signer
+	keyID string
+	alg   string
+	// The Service Account email, if signed with its key.
+	email string
+}
+
+// Returns a signer using the signing key of the settings if any, or the
+// Service Account key of the credentials otherwise. The algorithm and key ID
+// of the settings take precedence over those of the key.
+func newJWTSigner(credentialsJSON []byte, jwt *JWTSettings) (*jwtSigner, error) {
+	if jwt == nil {
+		jwt = &JWTSettings{}
+	}
+	signer := &jwtSigner{}
+	if key := jwt.SigningKey; key != nil {
+		signer.key = key.Signer
+		signer.keyID = key.KeyID
+		signer.alg = key.Algorithm
+	} else {
+		config, err := google.JWTConfigFromJSON(credentialsJSON)
+		if err != nil {
+			return nil, err
+		}
+		if signer.key, err = parsePEMPrivateKey(config.PrivateKey); err != nil {
+			return nil, err
+		}
+		signer.email = config.Email
+		signer.keyID = config.PrivateKeyID
+	}
+	if jwt.KeyID != "" {
+		signer.keyID = jwt.KeyID
+	}
+	if jwt.Algorithm != "" {
+		signer.alg = jwt.Algorithm
+	} else if signer.alg == "" {
+		signer.alg = defaultSigningAlgorithm(signer.key)
+	}
+	return signer, nil
+}
+
+// Signs the data with the key and algorithm of the signer.
+func (s *jwtSigner) signBlob(data []byte) ([]byte, error) {
+	return signJWS(s.key, s.alg, data)
+}
+
+// Returns a JWT with the given claims signed by the signer.
+func (s *jwtSigner) signJWT(claims map[string]interface{}) (string, error) {
+	header := map[string]interface{}{"alg": s.alg, "typ": "JWT"}
+	if s.keyID != "" {
+		header["kid"] = s.keyID
+	}
+	return encodeJWT(header, claims, s.signBlob)
+}
+
+// jwtClaimsTokenSource signs a new JWT with the claims of the settings on
+// each call to Token.
+type jwtClaimsTokenSource struct {
+	signer   *jwtSigner
+	audience string
+	scope    string
+	jwt      *JWTSettings
+}
+
+// Returns a token source of self-signed JWTs with the claims of the settings,
+// signed with the signing key of the settings if any, or the Service Account
+// key of the settings otherwise.
+func customJWTTokenSource(credentialsJSON []byte, settings *Settings) (oauth2.TokenSource, error) {
+	signer, err := newJWTSigner(credentialsJSON, settings.JWT)
+	if err != nil {
+		return nil, err
+	}
+	return jwtClaimsTokenSource{
+		signer:   signer,
+		audience: settings.Audience,
+		scope:    settings.Scope,
+		jwt:      settings.JWT,
+	}, nil
+}
+
+func (ts jwtClaimsTokenSource) Token() (*oauth2.Token, error) {
+	claims, exp, err := ts.jwt.buildClaims(ts.signer.email, ts.audience, ts.scope)
+	if err != nil {
+		return nil, err
+	}
+	jwt, err := ts.signer.signJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: jwt, TokenType: "Bearer", Expiry: exp}, nil
+}
+
+// Returns the claims of a JWT issued now by the given principal, and its
+// expiry. The principal is the default "iss" and "sub" claim, if not empty.
+// The expiry is read from the final "exp" claim, which custom claims may
+// override.
+func (s *JWTSettings) buildClaims(principal string, audience string, scope string) (map[string]interface{}, time.Time, error) {
+	if s == nil {
+		s = &JWTSettings{}
+	}
+	iat := time.Now()
+	lifetime := s.Lifetime
+	if lifetime == 0 {
+		lifetime = defaultJWTLifetime
+	}
+	exp := iat.Add(lifetime)
+	claims := map[string]interface{}{
+		"iat": iat.Unix(),
+		"exp": exp.Unix(),
+	}
+	if principal != "" {
+		claims["iss"] = principal
+		claims["sub"] = principal
+	}
+	if s.Issuer != "" {
+		claims["iss"] = s.Issuer
+	}
+	if s.Subject != "" {
+		claims["sub"] = s.Subject
+	}
+	if audience != "" {
+		claims["aud"] = audience
+	}
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	for k, v := range s.Claims {
+		claims[k] = v
+	}
+	if v, ok := s.Claims["exp"]; ok {
+		if exp, ok = numericDate(v); !ok {
+			return nil, time.Time{}, fmt.Errorf("Invalid exp claim %v: expected seconds since the epoch", v)
+		}
+	}
+	return claims, exp, nil
+}
+
+// Returns the time of a claim holding seconds since the epoch, such as
+// "exp". Returns false if the claim is not a number.
+func numericDate(v interface{}) (time.Time, bool) {
+	switch n := v.(type) {
+	case float64:
+		return time.Unix(int64(n), 0), true
+	case int:
+		return time.Unix(int64(n), 0), true
+	case int64:
+		return time.Unix(n, 0), true
+	case json.Number:
+		f, err := n.Float64()
+		return time.Unix(int64(f), 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+// GenerateServiceAccountJWT builds the claims of a self-signed JWT locally and
+// signs them with a Google-managed key of the Service Account, using a User
+// access token approved for the cloud-platform scope. No key of the Service
+// Account is needed.
+//
+// The "iss" and "sub" claims default to the Service Account, which should
+// therefore be given as an email.
+func GenerateServiceAccountJWT(accessToken string, serviceAccount string, audience string, scope string,
+	jwt *JWTSettings, delegates []string) (*oauth2.Token, error) {
+	claims, exp, err := jwt.buildClaims(serviceAccount, audience, scope)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode JWT claims: %v", err)
+	}
+	sig, err := SignServiceAccountJWT(accessToken, serviceAccount, payload, delegates)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: sig.SignedJWT, TokenType: "Bearer", Expiry: exp}, nil
+}
+
+// Encodes and signs a JWT with the given header and claims.
+func encodeJWT(header map[string]interface{}, claims map[string]interface{},
+	sign func(data []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("Failed to encode JWT claims: %v", err)
+	}
+	data := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sig, err := sign([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	return data + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// metadata implements fetching of tokens of the default Service Account
+// from the GCE metadata server, or the emulator set in GCE_METADATA_HOST.
+package util
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Environment variable overriding the host of the metadata server.
+const metadataHostEnvVar = "GCE_METADATA_HOST"
+
+// Documented address of the metadata server.
+const defaultMetadataHost = "169.254.169.254"
+
+// MetadataTokenSource returns a token source fetching tokens of the default
+// Service Account from the metadata server. ID tokens are fetched if
+// requested, and access tokens for the scopes otherwise. Without scopes,
+// access tokens carry the scopes of the instance.
+func MetadataTokenSource(ctx context.Context, settings *Settings) (oauth2.TokenSource, error) {
+	if settings.isIDTokenRequest() {
+		return metadataIDTokenSource{ctx, settings.Audience}, nil
+	}
+	return google.ComputeTokenSource("", strings.Fields(settings.Scope)...), nil
+}
+
+// metadataIDTokenSource fetches ID tokens for the audience from the metadata server.
+type metadataIDTokenSource struct {
+	ctx      context.Context
+	audience string
+}
+
+func (s metadataIDTokenSource) Token() (*oauth2.Token, error) {
+	v := url.Values{
+		"audience": {s.audience},
+		"format":   {"full"},
+	}
+	idToken, err := metadata.GetWithContext(s.ctx, "instance/service-accounts/default/identity?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return newIDToken(strings.TrimSpace(idToken), "")
+}
+
+// MetadataServiceAccountEmail returns the email of the default Service
+// Account of the metadata server.
+func MetadataServiceAccountEmail(ctx context.Context) (string, error) {
+	return metadata.EmailWithContext(ctx, "default")
+}
+
+// Returns the host of the metadata server.
+func metadataHost() string {
+	if host := os.Getenv(metadataHostEnvVar); host != "" {
+		return host
+	}
+	return defaultMetadataHost
+}
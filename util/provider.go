@@ -0,0 +1,240 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// provider implements the client credentials grant and the authorization
+// code flow with PKCE for OAuth 2.0 providers other than Google, such as
+// Okta and Keycloak.
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/authhandler"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// Grant types supported for generic providers.
+const (
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeAuthorizationCode = "authorization_code"
+)
+
+// Redirect URI of the authorization code flow if none is configured.
+// The loopback server listens on a dynamic port.
+const DefaultProviderRedirectURI = "http://localhost"
+
+// ProviderConfig is the configuration of a generic OAuth 2.0 provider,
+// as read from a provider file.
+type ProviderConfig struct {
+	// If specified, endpoints that are not set are discovered from the
+	// OpenID Connect discovery document of the issuer.
+	Issuer       string `json:"issuer,omitempty"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	AuthURL      string `json:"auth_url,omitempty"`
+	TokenURL     string `json:"token_url"`
+	// Endpoints used by the info, test and revoke commands.
+	UserinfoURL   string `json:"userinfo_url,omitempty"`
+	RevocationURL string `json:"revocation_url,omitempty"`
+	RedirectURI   string `json:"redirect_uri,omitempty"`
+	// Scopes are sent as given, without adding the Google OAuth scope prefix.
+	Scopes []string `json:"scopes,omitempty"`
+	// Audience is sent as "audience" parameter, as required by some
+	// providers to issue access tokens for a specific API.
+	Audience string `json:"audience,omitempty"`
+	// Defaults to authorization_code if AuthURL or Issuer is set, and to
+	// client_credentials otherwise.
+	GrantType string `json:"grant_type,omitempty"`
+}
+
+// ParseProviderConfig parses the content of a provider file.
+func ParseProviderConfig(data []byte) (*ProviderConfig, error) {
+	var config ProviderConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse provider file: %v", err)
+	}
+	return &config, nil
+}
+
+// GetGrantType returns the configured grant type, or the default one.
+func (p *ProviderConfig) GetGrantType() string {
+	if p.GrantType != "" {
+		return p.GrantType
+	} else if p.AuthURL != "" || p.Issuer != "" {
+		return GrantTypeAuthorizationCode
+	}
+	return GrantTypeClientCredentials
+}
+
+// ResolveIssuer sets the endpoints that are not configured from the
+// discovery document of the issuer, and checks that the issuer supports
+// the grant type. Does nothing if no issuer is configured.
+func (p *ProviderConfig) ResolveIssuer() error {
+	if p.Issuer == "" {
+		return nil
+	}
+	doc, err := p.discoverEndpoints()
+	if err != nil {
+		return err
+	}
+	if p.TokenURL == "" {
+		return fmt.Errorf("Issuer %s has no token endpoint", p.Issuer)
+	}
+	if p.GetGrantType() == GrantTypeAuthorizationCode && p.AuthURL == "" {
+		return fmt.Errorf("Issuer %s has no authorization endpoint, which is required for the authorization code flow", p.Issuer)
+	}
+	return doc.checkSupport(p.GetGrantType())
+}
+
+// Sets the endpoints that are not configured from the discovery document
+// of the issuer, and returns the document.
+func (p *ProviderConfig) discoverEndpoints() (*DiscoveryDocument, error) {
+	doc, err := Discover(p.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []struct {
+		discovered string
+		target     *string
+	}{
+		{doc.AuthorizationEndpoint, &p.AuthURL},
+		{doc.TokenEndpoint, &p.TokenURL},
+		{doc.UserinfoEndpoint, &p.UserinfoURL},
+		{doc.RevocationEndpoint, &p.RevocationURL},
+	}
+	for _, endpoint := range endpoints {
+		if *endpoint.target == "" {
+			*endpoint.target = endpoint.discovered
+		}
+	}
+	return doc, nil
+}
+
+// Validate returns an error if the configuration is incomplete for its
+// grant type.
+func (p *ProviderConfig) Validate() error {
+	if p.ClientID == "" {
+		return errors.New("Missing client ID for provider")
+	}
+	if p.TokenURL == "" {
+		return errors.New("Missing token URL for provider")
+	}
+	switch p.GetGrantType() {
+	case GrantTypeClientCredentials:
+		if p.ClientSecret == "" {
+			return errors.New("Missing client secret for client credentials grant")
+		}
+	case GrantTypeAuthorizationCode:
+		if p.AuthURL == "" {
+			return errors.New("Missing auth URL for authorization code flow")
+		}
+	default:
+		return fmt.Errorf("Unsupported grant type for provider: %s", p.GrantType)
+	}
+	return nil
+}
+
+// Returns the OAuth 2.0 client configuration for the given scopes.
+func (p *ProviderConfig) oauth2Config(scopes []string) *oauth2.Config {
+	redirectURI := p.RedirectURI
+	if redirectURI == "" {
+		redirectURI = DefaultProviderRedirectURI
+	}
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthURL,
+			TokenURL: p.TokenURL,
+		},
+		RedirectURL: redirectURI,
+		Scopes:      scopes,
+	}
+}
+
+// Digest returns a SHA-256 based identifier of the client and endpoints.
+// Scopes are part of the cache key, and the client secret and redirect URI
+// may change without affecting which tokens can be obtained. Returns an
+// empty string for nil.
+func (p *ProviderConfig) Digest() string {
+	if p == nil {
+		return ""
+	}
+	params := *p // Make a shallow copy
+	params.ClientSecret = ""
+	params.RedirectURI = ""
+	params.UserinfoURL, params.RevocationURL = "", ""
+	params.Scopes = nil
+	params.GrantType = p.GetGrantType()
+	data, _ := json.Marshal(params)
+	sum := sha256.Sum256(data)
+	return cacheKeyDigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// ProviderTokenSource returns a token source obtaining tokens from the
+// generic provider of the settings, for the scopes of the settings.
+//
+// The authorization code flow uses settings.AuthHandler to obtain the
+// authorization code, like 3LO with an OAuth Client ID.
+func ProviderTokenSource(ctx context.Context, settings *Settings) (oauth2.TokenSource, error) {
+	p := settings.Provider
+	if p == nil {
+		return nil, errors.New("No provider is configured")
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(settings.Scope)
+	if p.GetGrantType() == GrantTypeClientCredentials {
+		config := &clientcredentials.Config{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			TokenURL:     p.TokenURL,
+			Scopes:       scopes,
+		}
+		if p.Audience != "" {
+			config.EndpointParams = url.Values{"audience": {p.Audience}}
+		}
+		return config.TokenSource(ctx), nil
+	}
+	if settings.AuthHandler == nil {
+		return nil, errors.New("Authorization code flow requires an authorization handler")
+	}
+	authHandler := settings.AuthHandler
+	if p.Audience != "" {
+		authHandler = func(authCodeURL string) (string, string, error) {
+			return settings.AuthHandler(authCodeURL + "&audience=" + url.QueryEscape(p.Audience))
+		}
+	}
+	return authhandler.TokenSourceWithPKCE(ctx, p.oauth2Config(scopes), settings.State, authHandler,
+		GeneratePKCEParams()), nil
+}
+
+// Returns the client configuration used to refresh tokens of the settings,
+// either from the provider or from the OAuth Client ID file.
+func refreshClientConfig(settings *Settings) (*oauth2.Config, error) {
+	if settings.Provider != nil {
+		return settings.Provider.oauth2Config(strings.Fields(settings.Scope)), nil
+	}
+	return clientConfigFromJSON(settings.CredentialsJSON, strings.Fields(settings.Scope)...)
+}
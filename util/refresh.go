@@ -15,8 +15,12 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
+	"net/url"
 
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 	"golang.org/x/oauth2/google"
 )
 
@@ -33,10 +37,10 @@ type refreshCredentialsJSON struct {
 // using a refreshToken and an OAuth Client ID Credentials object.
 // Empty string is returned if this is not possible.
 func BuildRefreshTokenJSON(refreshToken string, creds *google.Credentials) string {
-	if refreshToken == "" {
+	if refreshToken == "" || creds == nil {
 		return ""
 	}
-	oauth2Config, err := google.ConfigFromJSON(creds.JSON)
+	oauth2Config, err := clientConfigFromJSON(string(creds.JSON))
 	if err != nil {
 		return ""
 	}
@@ -50,3 +54,32 @@ func BuildRefreshTokenJSON(refreshToken string, creds *google.Credentials) strin
 	refreshCredentialsJSON, _ := json.Marshal(refreshCredentials)
 	return string(refreshCredentialsJSON)
 }
+
+// RefreshTokenWithScope exchanges a refresh token for an access token limited
+// to the scopes of the given config, using the "scope" parameter of the refresh
+// grant (RFC 6749 section 6). The scopes must have been granted to the refresh
+// token. The refresh token is preserved in the returned token if the token
+// endpoint does not issue a new one.
+func RefreshTokenWithScope(ctx context.Context, config *oauth2.Config, refreshToken string) (*oauth2.Token, error) {
+	// The client credentials config sends the client authentication and the
+	// scopes, and allows the grant type to be overridden.
+	refreshConfig := &clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		TokenURL:     config.Endpoint.TokenURL,
+		Scopes:       config.Scopes,
+		EndpointParams: url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		},
+		AuthStyle: config.Endpoint.AuthStyle,
+	}
+	token, err := refreshConfig.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+	return token, nil
+}
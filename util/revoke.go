@@ -0,0 +1,287 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// revoke implements the revocation of access and refresh tokens at the
+// authorization server (RFC 7009).
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// GoogleRevokeURL is the revocation endpoint of Google's authorization server.
+const GoogleRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// Token type hints of the revocation request.
+const (
+	tokenTypeHintAccessToken  = "access_token"
+	tokenTypeHintRefreshToken = "refresh_token"
+)
+
+// revocationClient revokes tokens at a revocation endpoint. The client
+// authenticates if a client ID is set, as required by generic providers.
+type revocationClient struct {
+	url          string
+	clientID     string
+	clientSecret string
+}
+
+// Returns the client revoking tokens fetched with the given settings.
+func newRevocationClient(settings *Settings) (*revocationClient, error) {
+	if p := settings.Provider; p != nil {
+		if p.RevocationURL == "" {
+			return nil, errors.New("Provider has no revocation endpoint. Set revocation_url in the provider file, or use --issuer.")
+		}
+		return &revocationClient{url: p.RevocationURL, clientID: p.ClientID, clientSecret: p.ClientSecret}, nil
+	}
+	return &revocationClient{url: revokeURL(settings.CredentialsJSON)}, nil
+}
+
+// Returns the "revoke_uri" of the credentials file, which is set by some
+// tools, or Google's revocation endpoint.
+func revokeURL(credentialsJSON string) string {
+	type revokeURIJSON struct {
+		RevokeURI string `json:"revoke_uri"`
+	}
+	var c struct {
+		revokeURIJSON
+		Web       *revokeURIJSON `json:"web"`
+		Installed *revokeURIJSON `json:"installed"`
+	}
+	json.Unmarshal([]byte(credentialsJSON), &c)
+	if c.Web != nil && c.Web.RevokeURI != "" {
+		return c.Web.RevokeURI
+	} else if c.Installed != nil && c.Installed.RevokeURI != "" {
+		return c.Installed.RevokeURI
+	} else if c.RevokeURI != "" {
+		return c.RevokeURI
+	}
+	return GoogleRevokeURL
+}
+
+// Revokes the given token. Tokens that have already expired or been revoked
+// are not reported as errors.
+func (c *revocationClient) revoke(token string, tokenTypeHint string) error {
+	form := url.Values{"token": {token}}
+	if tokenTypeHint != "" {
+		form.Set("token_type_hint", tokenTypeHint)
+	}
+	if c.clientID != "" && c.clientSecret == "" {
+		form.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequest("POST", c.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var res struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	json.Unmarshal(body, &res)
+	if res.Error == "invalid_token" {
+		// Google responds with invalid_token for tokens that are no longer
+		// valid, which RFC 7009 treats as successfully revoked.
+		return nil
+	}
+	name := tokenTypeHint
+	if name == "" {
+		name = "token"
+	}
+	if res.Error != "" && res.ErrorDescription != "" {
+		return fmt.Errorf("Failed to revoke %s: %s: %s", name, res.Error, res.ErrorDescription)
+	} else if res.Error != "" {
+		return fmt.Errorf("Failed to revoke %s: %s", name, res.Error)
+	}
+	return fmt.Errorf("Failed to revoke %s: %s", name, resp.Status)
+}
+
+// Revokes the access token and the refresh token, if any, of the given token.
+func (c *revocationClient) revokeToken(token *oauth2.Token) error {
+	if err := c.revoke(token.AccessToken, tokenTypeHintAccessToken); err != nil {
+		return err
+	}
+	if token.RefreshToken != "" {
+		return c.revoke(token.RefreshToken, tokenTypeHintRefreshToken)
+	}
+	return nil
+}
+
+// Returns the type of the tokens of the cache entry if they cannot be
+// revoked at the authorization server, or an empty string otherwise.
+// Self-signed JWTs and ID tokens are valid until they expire. Exchanged,
+// STS, downscoped, CI OIDC and metadata server tokens are not issued by
+// the authorization server of the credentials.
+func unrevocableTokenType(key CacheKeyInfo) string {
+	switch key.AuthType {
+	case AuthTypeJWT, AuthTypeAPIKey, AuthTypeExchange, AuthTypeIDToken, AuthTypeCIOIDC, AuthTypeMetadata:
+		return key.AuthType
+	}
+	if key.IDToken {
+		return AuthTypeIDToken
+	} else if key.Sts {
+		return "sts"
+	} else if key.AccessBoundary != "" {
+		return "downscoped"
+	}
+	return ""
+}
+
+// Returns true if the token of the cache entry can be revoked at the
+// authorization server.
+func isRevocable(key CacheKeyInfo) bool {
+	return unrevocableTokenType(key) == ""
+}
+
+// Revokes the cached token for the given settings at the authorization
+// server, along with its refresh token, and removes it from the cache.
+func Revoke(settings *Settings, taskSettings *TaskSettings) error {
+	info := createKey(settings).Info()
+	info.AuthType = settings.GetAuthType()
+	if tokenType := unrevocableTokenType(info); tokenType != "" {
+		return errors.New("Tokens of type " + tokenType + " cannot be revoked. They are valid until they expire.")
+	}
+	if Cache == nil {
+		return errors.New("Revoking cached tokens requires a cache. Use --token to revoke a token that is not cached.")
+	}
+	digest := createKey(settings).Digest()
+	val, err := Cache.Get(digest)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return errors.New("No cached token found. Use --token to revoke a token that is not cached.")
+	}
+	entry, err := decodeCacheEntry(digest, val)
+	if err != nil {
+		return err
+	}
+	client, err := newRevocationClient(settings)
+	if err != nil {
+		return err
+	}
+	if err := client.revokeToken(entry.Token); err != nil {
+		return err
+	}
+	if err := evictCacheEntry(entry); err != nil {
+		return err
+	}
+	fmt.Println("Token revoked.")
+	return nil
+}
+
+// Revokes the given access or refresh token at the authorization server of
+// the given settings, and removes the cache entries holding it.
+func RevokeToken(settings *Settings, token string) error {
+	client, err := newRevocationClient(settings)
+	if err != nil {
+		return err
+	}
+	entries, err := ListCache()
+	if err != nil {
+		return err
+	}
+	tokenTypeHint := ""
+	for _, entry := range entries {
+		if entry.Token.AccessToken == token {
+			tokenTypeHint = tokenTypeHintAccessToken
+		} else if entry.Token.RefreshToken == token {
+			tokenTypeHint = tokenTypeHintRefreshToken
+		}
+	}
+	if err := client.revoke(token, tokenTypeHint); err != nil {
+		return err
+	}
+	// Revoking either token of an entry invalidates the other one.
+	_, err = DeleteCacheEntries(func(entry CacheEntry) bool {
+		return entry.Token.AccessToken == token || entry.Token.RefreshToken == token
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Token revoked.")
+	return nil
+}
+
+// Revokes all tokens in the cache, then resets the cache. Tokens that
+// cannot be revoked, such as self-signed JWTs and ID tokens, are only
+// deleted. Tokens that failed to be revoked are reported and kept in the
+// cache, so that the reset can be retried, and an error is returned.
+func ResetAndRevoke() error {
+	entries, err := ListCache()
+	if err != nil {
+		return err
+	}
+	revoked := 0
+	failed := map[string]bool{}
+	for _, entry := range entries {
+		if !isRevocable(entry.Key) {
+			continue
+		}
+		client := &revocationClient{url: entry.Key.RevocationURL}
+		if entry.Key.CredentialType == AuthTypeProvider {
+			if client.url == "" {
+				fmt.Printf("Skipped token %s: its provider has no revocation endpoint\n", shortDigest(entry.Digest))
+				continue
+			}
+			// The client secret is not cached. Confidential clients are
+			// revoked with their client ID only, which some providers reject.
+			client.clientID = entry.Key.Principal
+		} else if client.url == "" {
+			client.url = GoogleRevokeURL
+		}
+		if err := client.revokeToken(entry.Token); err != nil {
+			fmt.Printf("Failed to revoke token %s: %v\n", shortDigest(entry.Digest), err)
+			failed[entry.Digest] = true
+			continue
+		}
+		revoked++
+	}
+	if len(failed) == 0 {
+		if err := ClearCache(); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %d cached tokens.\n", revoked)
+		return nil
+	}
+	_, err = DeleteCacheEntries(func(entry CacheEntry) bool {
+		return !failed[entry.Digest]
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d cached tokens.\n", revoked)
+	return fmt.Errorf("Failed to revoke %d cached tokens. They are kept in the cache to retry.", len(failed))
+}
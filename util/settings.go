@@ -15,6 +15,8 @@
 package util
 
 import (
+	"time"
+
 	"golang.org/x/oauth2/authhandler"
 )
 
@@ -22,6 +24,12 @@ var AuthTypeOAuth = "oauth"
 var AuthTypeJWT = "jwt"
 var AuthTypeAPIKey = "apikey"
 var AuthTypeSSO = "sso"
+var AuthTypeDevice = "device"
+var AuthTypeIDToken = "idtoken"
+var AuthTypeExchange = "exchange"
+var AuthTypeCIOIDC = "ci-oidc"
+var AuthTypeMetadata = "metadata"
+var AuthTypeProvider = "provider"
 
 // An extensible structure that holds the credentials for
 // Google API authentication.
@@ -53,6 +61,26 @@ type Settings struct {
 	// Used for Service Account Impersonation.
 	// Exchange User access token for Service Account access token.
 	ServiceAccount string
+	// The chain of Service Accounts through which ServiceAccount is impersonated.
+	Delegates []string
+	// The lifetime of the impersonated Service Account access token.
+	// Defaults to one hour if zero.
+	ServiceAccountLifetime time.Duration
+	// The parameters of an RFC 8693 token exchange, used with AuthTypeExchange.
+	// The requested scopes are taken from Scope.
+	TokenExchange *TokenExchangeRequest
+	// If specified, the token is downscoped to the access boundary.
+	AccessBoundary *AccessBoundary
+	// The STS endpoint used for downscoping and federation. Defaults to GoogleStsTokenURL.
+	StsEndpoint string
+	// The CI provider issuing the OIDC token used with AuthTypeCIOIDC.
+	CIProvider string
+	// The full resource name of the Workload Identity Provider trusting the CI provider.
+	WorkloadIdentityProvider string
+	// The generic OAuth 2.0 provider used with AuthTypeProvider.
+	Provider *ProviderConfig
+	// Custom claims of self-signed JWTs used with AuthTypeJWT.
+	JWT *JWTSettings
 }
 
 func (s Settings) GetAuthType() string {
@@ -65,3 +93,13 @@ func (s Settings) GetAuthType() string {
 	}
 	return AuthTypeJWT
 }
+
+// Returns true if an ID token for the audience is requested, either with
+// the idtoken authentication type, or from the metadata server with an
+// audience but neither scopes nor STS.
+func (s Settings) isIDTokenRequest() bool {
+	if s.GetAuthType() == AuthTypeMetadata {
+		return s.Audience != "" && s.Scope == "" && !s.Sts
+	}
+	return s.GetAuthType() == AuthTypeIDToken
+}
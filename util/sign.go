@@ -0,0 +1,144 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// sign implements signing of arbitrary payloads and JWT claims, either
+// locally with a Service Account key or signing key, or by IAM with a
+// Google-managed key of an impersonated Service Account.
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SignRequest is a payload to sign.
+type SignRequest struct {
+	Payload []byte
+	// If true, the payload is a JSON object of claims signed as JWT.
+	JWT bool
+}
+
+// Signature is the result of signing a payload.
+type Signature struct {
+	// ID of the key that signed the payload, if known.
+	KeyID string `json:"key_id,omitempty"`
+	// Base64 encoded signature of a payload signed as is.
+	Signature string `json:"signature,omitempty"`
+	// Signed JWT of a payload signed as JWT.
+	SignedJWT string `json:"signed_jwt,omitempty"`
+}
+
+// Sign signs the payload of the request and prints the signature with the
+// format of the task settings. Returns an error if the payload was not signed.
+//
+// If settings.ServiceAccount is set, the payload is signed by IAM on behalf
+// of the credentials of the settings, whose token for the cloud-platform
+// scope is fetched and cached like any other token. Otherwise, the payload
+// is signed locally with the signing key of settings.JWT, or the Service
+// Account key of the credentials.
+func Sign(settings *Settings, taskSettings *TaskSettings, request *SignRequest) error {
+	var claims map[string]interface{}
+	if request.JWT {
+		if err := json.Unmarshal(request.Payload, &claims); err != nil || claims == nil {
+			return errors.New("Payload of a JWT must be a JSON object of claims")
+		}
+	}
+	var sig *Signature
+	var err error
+	if settings.ServiceAccount != "" {
+		iamSettings := *settings // Make a shallow copy
+		iamSettings.AuthType = AuthTypeOAuth
+		iamSettings.Scope = iamScope
+		iamSettings.ServiceAccount = ""
+		iamSettings.Delegates = nil
+		iamSettings.JWT = nil
+		token, err := fetchToken(&iamSettings, taskSettings)
+		if err != nil {
+			return err
+		}
+		if request.JWT {
+			sig, err = SignServiceAccountJWT(token.AccessToken, settings.ServiceAccount, request.Payload, settings.Delegates)
+		} else {
+			sig, err = SignServiceAccountBlob(token.AccessToken, settings.ServiceAccount, request.Payload, settings.Delegates)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		sig, err = signLocally(settings, request.Payload, claims)
+		if err != nil {
+			return err
+		}
+	}
+	return printSignature(sig, taskSettings.Format)
+}
+
+// Signs the payload, or the claims if not nil, with the signing key of
+// settings.JWT or the Service Account key of the credentials.
+func signLocally(settings *Settings, payload []byte, claims map[string]interface{}) (*Signature, error) {
+	var credentialsJSON []byte
+	if settings.JWT == nil || settings.JWT.SigningKey == nil {
+		creds, err := FindJSONCredentials(context.Background(), settings)
+		if err != nil {
+			return nil, err
+		}
+		if getCredentialType(creds) != serviceAccountKey {
+			return nil, errors.New("Signing locally requires Service Account credentials or a signing key. " +
+				"Use --impersonate-service-account to sign with IAM instead.")
+		}
+		credentialsJSON = creds.JSON
+	}
+	signer, err := newJWTSigner(credentialsJSON, settings.JWT)
+	if err != nil {
+		return nil, err
+	}
+	if claims != nil {
+		jwt, err := signer.signJWT(claims)
+		if err != nil {
+			return nil, err
+		}
+		return &Signature{KeyID: signer.keyID, SignedJWT: jwt}, nil
+	}
+	sig, err := signer.signBlob(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{KeyID: signer.keyID, Signature: base64.StdEncoding.EncodeToString(sig)}, nil
+}
+
+// Prints the signature with the specified format. The bare format prints
+// the signature or signed JWT only, and the json format includes the key ID.
+func printSignature(sig *Signature, format string) error {
+	switch format {
+	case formatBare:
+		if sig.SignedJWT != "" {
+			fmt.Println(sig.SignedJWT)
+		} else {
+			fmt.Println(sig.Signature)
+		}
+	case formatJson:
+		data, err := json.MarshalIndent(sig, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		return fmt.Errorf("Output format %s is not supported for signatures", format)
+	}
+	return nil
+}
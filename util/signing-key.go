@@ -0,0 +1,269 @@
+//
+// Copyright 2026 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// signing-key implements the parsing of PEM, JWK and JWKS private keys,
+// and the signing of JWTs with RSA and EC keys.
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Supported JWT signing algorithms.
+const (
+	AlgRS256 = "RS256"
+	AlgRS384 = "RS384"
+	AlgRS512 = "RS512"
+	AlgPS256 = "PS256"
+	AlgES256 = "ES256"
+	AlgES384 = "ES384"
+)
+
+// SigningKey is a private key used to sign JWTs instead of the key of a
+// Service Account.
+type SigningKey struct {
+	Signer crypto.Signer
+	// The "kid" of the JWK, if any.
+	KeyID string
+	// The "alg" of the JWK, if any.
+	Algorithm string
+}
+
+// The private key fields of a JWK (RFC 7517, RFC 7518 section 6).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA keys
+	N  string `json:"n,omitempty"`
+	E  string `json:"e,omitempty"`
+	D  string `json:"d,omitempty"`
+	P  string `json:"p,omitempty"`
+	Q  string `json:"q,omitempty"`
+	Dp string `json:"dp,omitempty"`
+	Dq string `json:"dq,omitempty"`
+	Qi string `json:"qi,omitempty"`
+	// EC keys, which also use D
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// ParseSigningKey parses a PEM encoded RSA or EC private key, a JWK or a
+// JWKS. For a JWKS, the key with the given key ID is used, or its only key
+// if the key ID is empty.
+func ParseSigningKey(data []byte, keyID string) (*SigningKey, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(trimmed, "{") {
+		signer, err := parsePEMPrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{Signer: signer}, nil
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Failed to parse JWK: %v", err)
+	}
+	if set.Keys == nil {
+		return parseJWK(data)
+	}
+	var keys []*SigningKey
+	for _, k := range set.Keys {
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		if keyID == "" || key.KeyID == keyID {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No key with kid %q found in JWKS", keyID)
+	} else if len(keys) > 1 {
+		return nil, errors.New("JWKS contains multiple keys. Select one with --kid.")
+	}
+	return keys[0], nil
+}
+
+// Parses a PEM encoded private key in PKCS #8, PKCS #1 or SEC 1 format.
+func parsePEMPrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Signing key is neither a PEM encoded private key nor a JWK")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("Unsupported private key type")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Failed to parse %s", block.Type)
+}
+
+func parseJWK(data []byte) (*SigningKey, error) {
+	var k jwk
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("Failed to parse JWK: %v", err)
+	}
+	if k.D == "" {
+		return nil, fmt.Errorf("JWK %s has no private key", k.Kid)
+	}
+	var signer crypto.Signer
+	var err error
+	switch k.Kty {
+	case "RSA":
+		signer, err = k.rsaPrivateKey()
+	case "EC":
+		signer, err = k.ecPrivateKey()
+	default:
+		err = fmt.Errorf("Unsupported JWK key type: %s", k.Kty)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Signer: signer, KeyID: k.Kid, Algorithm: k.Alg}, nil
+}
+
+func (k jwk) rsaPrivateKey() (*rsa.PrivateKey, error) {
+	ints, err := decodeBigInts(k.N, k.E, k.D, k.P, k.Q)
+	if err != nil {
+		return nil, err
+	}
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: ints[0], E: int(ints[1].Int64())},
+		D:         ints[2],
+		Primes:    []*big.Int{ints[3], ints[4]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid RSA JWK %s: %v", k.Kid, err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+func (k jwk) ecPrivateKey() (*ecdsa.PrivateKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("Unsupported JWK curve: %s", k.Crv)
+	}
+	ints, err := decodeBigInts(k.X, k.Y, k.D)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: ints[0], Y: ints[1]},
+		D:         ints[2],
+	}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("Invalid EC JWK %s: point is not on curve %s", k.Kid, k.Crv)
+	}
+	return key, nil
+}
+
+// Decodes base64url encoded unsigned big-endian integers.
+func decodeBigInts(values ...string) ([]*big.Int, error) {
+	ints := make([]*big.Int, len(values))
+	for i, v := range values {
+		if v == "" {
+			return nil, errors.New("JWK is missing key parameters")
+		}
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWK key parameter: %v", err)
+		}
+		ints[i] = new(big.Int).SetBytes(b)
+	}
+	return ints, nil
+}
+
+// Returns the algorithm used for the key if none is specified.
+func defaultSigningAlgorithm(signer crypto.Signer) string {
+	if key, ok := signer.(*ecdsa.PrivateKey); ok && key.Curve == elliptic.P384() {
+		return AlgES384
+	} else if ok {
+		return AlgES256
+	}
+	return AlgRS256
+}
+
+// Signs data with the given key and JWT algorithm.
+func signJWS(signer crypto.Signer, alg string, data []byte) ([]byte, error) {
+	var hash crypto.Hash
+	switch alg {
+	case AlgRS256, AlgPS256, AlgES256:
+		hash = crypto.SHA256
+	case AlgRS384, AlgES384:
+		hash = crypto.SHA384
+	case AlgRS512:
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("Unsupported signing algorithm: %s", alg)
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch key := signer.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		} else if alg == AlgPS256 {
+			return rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return nil, fmt.Errorf("Signing algorithm %s is not supported for RSA keys", alg)
+	case *ecdsa.PrivateKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if (alg == AlgES256 && size == 32) || (alg == AlgES384 && size == 48) {
+			r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS uses the fixed size concatenation of r and s instead of
+			// the ASN.1 encoding.
+			sig := make([]byte, 2*size)
+			r.FillBytes(sig[:size])
+			s.FillBytes(sig[size:])
+			return sig, nil
+		}
+		return nil, fmt.Errorf("Signing algorithm %s is not supported for EC %s keys", alg, key.Curve.Params().Name)
+	}
+	return nil, fmt.Errorf("Unsupported signing key type: %T", signer)
+}
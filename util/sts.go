@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 )
@@ -32,27 +33,103 @@ import (
 // TODO (andyzhao): Replace with https://sts.googleapis.com/v1/token when ready.
 const StsURL = "https://securetoken.googleapis.com/v1alpha2/identitybindingtoken"
 
+// GoogleStsTokenURL is Google's Security Token Service endpoint implementing RFC 8693.
+const GoogleStsTokenURL = "https://sts.googleapis.com/v1/token"
+
+// Grant type of RFC 8693 token exchange requests.
+const tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// Token type identifiers defined by RFC 8693.
+const (
+	TokenTypeAccessToken  = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeRefreshToken = "urn:ietf:params:oauth:token-type:refresh_token"
+	TokenTypeIDToken      = "urn:ietf:params:oauth:token-type:id_token"
+	TokenTypeJWT          = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeSAML1        = "urn:ietf:params:oauth:token-type:saml1"
+	TokenTypeSAML2        = "urn:ietf:params:oauth:token-type:saml2"
+)
+
+// TokenExchangeRequest holds the parameters of an RFC 8693 token exchange.
+type TokenExchangeRequest struct {
+	// The token endpoint of the Security Token Service.
+	Endpoint           string   `json:"endpoint"`
+	SubjectToken       string   `json:"subject_token"`
+	SubjectTokenType   string   `json:"subject_token_type"`
+	ActorToken         string   `json:"actor_token,omitempty"`
+	ActorTokenType     string   `json:"actor_token_type,omitempty"`
+	Resource           []string `json:"resource,omitempty"`
+	Audience           []string `json:"audience,omitempty"`
+	RequestedTokenType string   `json:"requested_token_type,omitempty"`
+	// Space delimited scopes of the requested token.
+	Scope string `json:"scope,omitempty"`
+	// JSON encoded options, such as the access boundary of downscoped tokens.
+	// Not part of RFC 8693.
+	Options string `json:"options,omitempty"`
+	// Additional HTTP headers sent with the request, such as X-Goog-Auth-Claims.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
 // tokenJSON is the struct representing the HTTP response from STS
 type tokenJSON struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
+	AccessToken string      `json:"access_token"`
+	TokenType   string      `json:"token_type"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// tokenErrorJSON is the struct representing an error response from STS
+type tokenErrorJSON struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 // Exchanges an OAuth Access Token to an Sts token with base64 encoded claims
 func StsExchange(accessToken string, encodedClaims string) (*oauth2.Token, error) {
+	return ExchangeToken(&TokenExchangeRequest{
+		Endpoint:           StsURL,
+		SubjectToken:       accessToken,
+		SubjectTokenType:   TokenTypeAccessToken,
+		RequestedTokenType: TokenTypeAccessToken,
+		Headers:            map[string]string{"X-Goog-Auth-Claims": encodedClaims},
+	})
+}
+
+// ExchangeToken performs an RFC 8693 token exchange. The expiry of the
+// returned token is set from "expires_in", and all other response fields,
+// such as "issued_token_type", are available as extra fields.
+func ExchangeToken(request *TokenExchangeRequest) (*oauth2.Token, error) {
 	v := url.Values{
-		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
-		"subject_token_type":   {"urn:ietf:params:oauth:token-type:access_token"},
-		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
-		"subject_token":        {accessToken},
+		"grant_type":         {tokenExchangeGrantType},
+		"subject_token":      {request.SubjectToken},
+		"subject_token_type": {request.SubjectTokenType},
+	}
+	if request.ActorToken != "" {
+		v.Set("actor_token", request.ActorToken)
+		v.Set("actor_token_type", request.ActorTokenType)
+	}
+	for _, resource := range request.Resource {
+		v.Add("resource", resource)
+	}
+	for _, audience := range request.Audience {
+		v.Add("audience", audience)
+	}
+	if request.RequestedTokenType != "" {
+		v.Set("requested_token_type", request.RequestedTokenType)
+	}
+	if request.Scope != "" {
+		v.Set("scope", request.Scope)
+	}
+	if request.Options != "" {
+		v.Set("options", request.Options)
 	}
 
-	req, err := http.NewRequest("POST", StsURL, strings.NewReader(v.Encode()))
+	req, err := http.NewRequest("POST", request.Endpoint, strings.NewReader(v.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("X-Goog-Auth-Claims", encodedClaims)
+	for name, value := range request.Headers {
+		req.Header.Set(name, value)
+	}
 	client := http.DefaultClient
 	resp, err := client.Do(req)
 	if err != nil {
@@ -64,6 +141,13 @@ func StsExchange(accessToken string, encodedClaims string) (*oauth2.Token, error
 		return nil, fmt.Errorf("oauth2l: STS exchange failed: %v", err)
 	}
 	if code := resp.StatusCode; code < 200 || code > 299 {
+		var tej tokenErrorJSON
+		if json.Unmarshal(body, &tej) == nil && tej.Error != "" {
+			if tej.ErrorDescription != "" {
+				return nil, fmt.Errorf("oauth2l: STS exchange failed: %s: %s", tej.Error, tej.ErrorDescription)
+			}
+			return nil, fmt.Errorf("oauth2l: STS exchange failed: %s", tej.Error)
+		}
 		return nil, errors.New(string(body))
 	}
 
@@ -74,11 +158,34 @@ func StsExchange(accessToken string, encodedClaims string) (*oauth2.Token, error
 	token := oauth2.Token{}
 	token.AccessToken = tj.AccessToken
 	token.TokenType = tj.TokenType
+	if expiresIn, err := tj.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
 	var raw map[string]interface{}
 	json.Unmarshal(body, &raw)
 	return token.WithExtra(raw), nil
 }
 
+// exchangeTokenSource performs the token exchange for each token.
+type exchangeTokenSource struct {
+	request *TokenExchangeRequest
+}
+
+func (s exchangeTokenSource) Token() (*oauth2.Token, error) {
+	return ExchangeToken(s.request)
+}
+
+// ExchangeTokenSource returns a token source exchanging the subject token of
+// settings.TokenExchange for a token with the requested scopes.
+func ExchangeTokenSource(settings *Settings) (oauth2.TokenSource, error) {
+	if settings.TokenExchange == nil {
+		return nil, errors.New("Token exchange parameters are required")
+	}
+	request := *settings.TokenExchange // Make a shallow copy
+	request.Scope = settings.Scope
+	return exchangeTokenSource{&request}, nil
+}
+
 // claimsJSON is the struct representing supported STS claims
 type claimsJSON struct {
 	Audience string `json:"audience,omitempty"`
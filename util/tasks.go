@@ -16,12 +16,14 @@ package util
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"golang.org/x/oauth2"
@@ -31,6 +33,9 @@ import (
 const (
 	// Base URL to fetch the token info
 	googleTokenInfoURLPrefix = "https://www.googleapis.com/oauth2/v3/tokeninfo/?access_token="
+
+	// Common prefix for google oauth scope
+	googleScopePrefix = "https://www.googleapis.com/auth/"
 )
 
 // Supported output formats
@@ -43,6 +48,10 @@ const (
 	formatRefreshToken = "refresh_token"
 )
 
+// ErrPromptDisabled is returned if authorization is required, but
+// prompting is disabled by TaskSettings.NoPrompt.
+var ErrPromptDisabled = errors.New("Authorization is required, but prompting is disabled by --no-prompt.")
+
 // Credentials file types.
 // If type is not one of the below, it means the file is a
 // Google Client ID JSON.
@@ -50,6 +59,8 @@ const (
 	serviceAccountKey  = "service_account"
 	userCredentialsKey = "authorized_user"
 	externalAccountKey = "external_account"
+	// Not an actual type. Used to describe OAuth Client ID files.
+	clientIdCredentialType = "client_id"
 )
 
 // An extensible structure that holds the settings
@@ -67,37 +78,75 @@ type TaskSettings struct {
 	Url string
 	// Extra args for Curl task
 	ExtraArgs []string
+	// Send API keys as "key" query parameter instead of header for Curl task
+	APIKeyParam bool
 	// SsoCli override for Sso task
 	SsoCli string
-	// Refresh expired access token in cache
+	// Deprecated: expired access tokens in cache are always refreshed if
+	// they have a refresh token.
 	Refresh bool
+	// Fail instead of prompting the user for authorization.
+	NoPrompt bool
+	// Minimum remaining validity of cached tokens. Tokens expiring sooner
+	// are refreshed or fetched again.
+	MinValidity time.Duration
+	// Maximum time tokens without expiry, such as SSO and STS tokens, are
+	// served from the cache. Tokens without expiry are cached indefinitely
+	// if zero.
+	CacheTTL time.Duration
 }
 
 // Fetches and prints the token in plain text with the given settings
-// using Google Authenticator.
-func Fetch(settings *Settings, taskSettings *TaskSettings) {
-	token := fetchToken(settings, taskSettings)
+// using Google Authenticator. Returns an error if no token was obtained.
+func Fetch(settings *Settings, taskSettings *TaskSettings) error {
+	if settings.GetAuthType() == AuthTypeAPIKey {
+		return printAPIKey(settings.APIKey, taskSettings.Format)
+	}
+	token, err := fetchToken(settings, taskSettings)
+	if err != nil {
+		return err
+	}
 	printToken(token, taskSettings.Format, settings)
+	return nil
 }
 
 // Fetches and prints the token in header format with the given settings
 // using Google Authenticator.
-func Header(settings *Settings, taskSettings *TaskSettings) {
+func Header(settings *Settings, taskSettings *TaskSettings) error {
 	taskSettings.Format = formatHeader
-	Fetch(settings, taskSettings)
+	return Fetch(settings, taskSettings)
 }
 
 // Fetches token with the given settings using Google Authenticator
 // and use the token as header to make curl request.
-func Curl(settings *Settings, taskSettings *TaskSettings) {
-	token := fetchToken(settings, taskSettings)
-	if token != nil {
-		header := BuildHeader(token.TokenType, token.AccessToken)
-		curlcli := taskSettings.CurlCli
+// API keys are sent as X-Goog-Api-Key header, or as "key" query parameter
+// if taskSettings.APIKeyParam is set.
+// Returns an error if no token was obtained.
+func Curl(settings *Settings, taskSettings *TaskSettings) error {
+	if settings.GetAuthType() == AuthTypeAPIKey {
+		header := BuildAPIKeyHeader(settings.APIKey)
 		url := taskSettings.Url
-		extraArgs := taskSettings.ExtraArgs
-		CurlCommand(curlcli, header, url, extraArgs...)
+		if taskSettings.APIKeyParam {
+			var err error
+			url, err = addAPIKeyParam(url, settings.APIKey)
+			if err != nil {
+				return err
+			}
+			header = ""
+		}
+		CurlCommand(taskSettings.CurlCli, header, url, taskSettings.ExtraArgs...)
+		return nil
 	}
+	token, err := fetchToken(settings, taskSettings)
+	if err != nil {
+		return err
+	}
+	header := BuildHeader(token.TokenType, token.AccessToken)
+	curlcli := taskSettings.CurlCli
+	url := taskSettings.Url
+	extraArgs := taskSettings.ExtraArgs
+	CurlCommand(curlcli, header, url, extraArgs...)
+	return nil
 }
 
 // Fetches the information of the given token.
@@ -124,6 +173,31 @@ func Test(token string) int {
 	}
 }
 
+// Fetches the information of the given token from the userinfo endpoint
+// of the given OpenID Connect issuer.
+func IssuerInfo(issuer string, token string) int {
+	info, err := getUserInfo(issuer, token)
+	if err != nil {
+		fmt.Print(err)
+	} else {
+		fmt.Println(info)
+	}
+	return 0
+}
+
+// Tests the given token against the userinfo endpoint of the given
+// OpenID Connect issuer. Returns 0 for valid tokens. Otherwise returns 1.
+func IssuerTest(issuer string, token string) int {
+	_, err := getUserInfo(issuer, token)
+	if err != nil {
+		fmt.Println(1)
+		return 1
+	} else {
+		fmt.Println(0)
+		return 0
+	}
+}
+
 // Resets the cache.
 func Reset() {
 	err := ClearCache()
@@ -132,6 +206,116 @@ func Reset() {
 	}
 }
 
+// Selects entries of the cache. Empty fields match all entries.
+type CacheFilter struct {
+	// Matches entries fetched with the given credentials.
+	CredentialsJSON string
+	// Matches entries whose scopes include all of the given scopes.
+	Scope    string
+	Audience string
+	Email    string
+	// Matches entries for the given impersonated Service Account.
+	ServiceAccount string
+	// Matches expired entries only.
+	Expired bool
+}
+
+// Returns true if the given cache entry is selected by the filter.
+func (f *CacheFilter) Matches(entry CacheEntry) bool {
+	if f.CredentialsJSON != "" && getCredentialsIdentity(f.CredentialsJSON).Digest() != entry.Key.CredentialsDigest {
+		return false
+	}
+	if !containsScopes(entry.Key.Scope, f.Scope) {
+		return false
+	}
+	if f.Audience != "" && f.Audience != entry.Key.Audience {
+		return false
+	}
+	if f.Email != "" && f.Email != entry.Key.Email {
+		return false
+	}
+	if f.ServiceAccount != "" && f.ServiceAccount != entry.Key.ServiceAccount {
+		return false
+	}
+	return !f.Expired || isTokenExpired(entry.Token)
+}
+
+// Lists the cached tokens selected by the filter, without revealing
+// the tokens themselves.
+func CacheList(filter *CacheFilter) error {
+	entries, err := ListCache()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tPRINCIPAL\tSCOPES\tAUDIENCE\tSTS\tIMPERSONATE\tEXPIRY")
+	for _, entry := range entries {
+		if !filter.Matches(entry) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\t%s\n",
+			shortDigest(entry.Digest),
+			orNone(entry.Key.CredentialType),
+			orNone(entry.Key.Principal),
+			orNone(shortScopes(entry.Key.Scope)),
+			orNone(entry.Key.Audience),
+			entry.Key.Sts,
+			orNone(entry.Key.ServiceAccount),
+			formatExpiry(entry.Token))
+	}
+	return w.Flush()
+}
+
+// Shows the cached token with the given ID, without revealing
+// the token itself.
+func CacheShow(id string) error {
+	entries, err := ListCache()
+	if err != nil {
+		return err
+	}
+	var found []CacheEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Digest, id) || strings.HasPrefix(shortDigest(entry.Digest), id) {
+			found = append(found, entry)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("No cache entry found for ID: %s", id)
+	} else if len(found) > 1 {
+		return fmt.Errorf("Ambiguous ID: %s", id)
+	}
+	entry := found[0]
+	refreshToken := "absent"
+	if entry.Token.RefreshToken != "" {
+		refreshToken = "present"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", entry.Digest)
+	fmt.Fprintf(w, "Authentication type:\t%s\n", orNone(entry.Key.AuthType))
+	fmt.Fprintf(w, "Credential type:\t%s\n", orNone(entry.Key.CredentialType))
+	fmt.Fprintf(w, "Principal:\t%s\n", orNone(entry.Key.Principal))
+	fmt.Fprintf(w, "Scopes:\t%s\n", orNone(entry.Key.Scope))
+	fmt.Fprintf(w, "Audience:\t%s\n", orNone(entry.Key.Audience))
+	fmt.Fprintf(w, "Email:\t%s\n", orNone(entry.Key.Email))
+	fmt.Fprintf(w, "Quota project:\t%s\n", orNone(entry.Key.QuotaProject))
+	fmt.Fprintf(w, "STS:\t%t\n", entry.Key.Sts)
+	fmt.Fprintf(w, "Impersonated service account:\t%s\n", orNone(entry.Key.ServiceAccount))
+	fmt.Fprintf(w, "Token type:\t%s\n", entry.Token.Type())
+	fmt.Fprintf(w, "Refresh token:\t%s\n", refreshToken)
+	fmt.Fprintf(w, "Expiry:\t%s\n", formatExpiry(entry.Token))
+	return w.Flush()
+}
+
+// Deletes the cached tokens selected by the filter.
+func CacheDelete(filter *CacheFilter) error {
+	deleted, err := DeleteCacheEntries(filter.Matches)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d cache entries.\n", deleted)
+	return nil
+}
+
 // Returns the given token in standard header format.
 func BuildHeader(tokenType string, token string) string {
 	return fmt.Sprintf("Authorization: %s %s", tokenType, token)
@@ -150,81 +334,309 @@ func getTokenInfo(token string) (string, error) {
 	return string(data), err
 }
 
+func getUserInfo(issuer string, token string) (string, error) {
+	provider := &ProviderConfig{Issuer: issuer}
+	if _, err := provider.discoverEndpoints(); err != nil {
+		return "", err
+	}
+	if provider.UserinfoURL == "" {
+		return "", fmt.Errorf("Issuer %s has no userinfo endpoint", issuer)
+	}
+	req, err := http.NewRequest("GET", provider.UserinfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return "", errors.New(string(data))
+	}
+	return string(data), err
+}
+
 // fetchToken attempts to fetch and cache an access token.
 //
 // If SSO is specified, obtain token via SSOFetch instead of FetchToken.
 //
-// If cached token is expired and refresh is requested,
-// attempt to obtain new token via RefreshToken instead
-// of default OAuth flow.
+// If cached token is expired or expires within the minimum
+// validity, attempt to obtain new token via its RefreshToken
+// instead of default OAuth flow. If the refresh token has been
+// revoked or has expired, the cache entry is evicted and the
+// default OAuth flow is used, unless prompting is disabled.
+//
+// If a token for a superset of the requested scopes is cached
+// along with a refresh token, the refresh token is used to obtain
+// a token for the requested scopes without authorizing again.
 //
 // If STS is requested, we will perform an STS exchange
 // after the original access token has been fetched.
-func fetchToken(settings *Settings, taskSettings *TaskSettings) *oauth2.Token {
-	token, err := LookupCache(settings)
-	tokenExpired := isTokenExpired(token)
+//
+// If an access boundary is specified, the token is downscoped by
+// fetchDownscopedToken.
+func fetchToken(settings *Settings, taskSettings *TaskSettings) (*oauth2.Token, error) {
+	if settings.AccessBoundary != nil {
+		return fetchDownscopedToken(settings, taskSettings)
+	}
+	usable := func(entry *CacheEntry) bool {
+		return !isCacheEntryStale(entry, taskSettings)
+	}
+	entry, err := lookupCacheEntry(settings, usable)
+	if err != nil {
+		return nil, err
+	}
+	var token *oauth2.Token
+	if entry != nil {
+		token = entry.Token
+	}
+	tokenExpired := entry != nil && isCacheEntryStale(entry, taskSettings)
 	if token == nil || tokenExpired {
+		// Only one process fetches the token for a given key at a time.
+		// Others wait and reuse the token once it has been cached.
+		unlock, err := lockCacheKey(settings)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		if cached, err := lookupCacheEntry(settings, usable); err == nil && cached != nil && usable(cached) {
+			return cached.Token, nil
+		}
+
 		if taskSettings.AuthType == "sso" {
 			token, err = SSOFetch(taskSettings.SsoCli, settings.Email, settings.Scope)
 			if err != nil {
-				fmt.Println(err)
-				return nil
+				return nil, err
 			}
 		} else {
-			fetchSettings := settings
-			if tokenExpired && taskSettings.Refresh {
-				// If creds cannot be retrieved here, which is unexpected, we will ignore
-				// the error and let FetchToken return a standardized error message
-				// in the subsequent step.
-				creds, _ := FindJSONCredentials(context.Background(), settings)
-				refreshTokenJSON := BuildRefreshTokenJSON(token.RefreshToken, creds)
-				if refreshTokenJSON != "" {
-					refreshSettings := *settings // Make a shallow copy
-					refreshSettings.CredentialsJSON = refreshTokenJSON
-					fetchSettings = &refreshSettings
+			token, err = refreshCachedToken(settings, entry)
+			if err != nil {
+				return nil, err
+			}
+			if token == nil {
+				token, err = refreshSupersetToken(settings)
+				if err != nil {
+					return nil, err
 				}
 			}
-			token, err = FetchToken(context.Background(), fetchSettings)
-			if err != nil {
-				fmt.Println(err)
-				return nil
+			if token == nil {
+				if taskSettings.NoPrompt && requiresConsent(settings) {
+					return nil, ErrPromptDisabled
+				}
+				fetchSettings := settings
+				if settings.ServiceAccount != "" && (settings.isIDTokenRequest() || settings.GetAuthType() == AuthTypeMetadata ||
+					settings.GetAuthType() == AuthTypeJWT) {
+					// The token is generated by IAM, which requires an access
+					// token of the base credentials for the cloud-platform scope.
+					iamSettings := *settings // Make a shallow copy
+					if iamSettings.AuthType == AuthTypeIDToken || iamSettings.GetAuthType() == AuthTypeJWT {
+						iamSettings.AuthType = AuthTypeOAuth
+					}
+					iamSettings.Scope = iamScope
+					fetchSettings = &iamSettings
+				}
+				token, err = FetchToken(context.Background(), fetchSettings)
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
-		if settings.ServiceAccount != "" {
-			token, err = GenerateServiceAccountAccessToken(token.AccessToken, settings.ServiceAccount, settings.Scope)
+		if settings.ServiceAccount != "" && settings.isIDTokenRequest() {
+			token, err = GenerateServiceAccountIdToken(token.AccessToken, settings.ServiceAccount, settings.Audience,
+				settings.Delegates)
 			if err != nil {
-				fmt.Println(err)
-				return nil
+				return nil, err
+			}
+		} else if settings.ServiceAccount != "" && settings.GetAuthType() == AuthTypeJWT {
+			token, err = GenerateServiceAccountJWT(token.AccessToken, settings.ServiceAccount, settings.Audience,
+				settings.Scope, settings.JWT, settings.Delegates)
+			if err != nil {
+				return nil, err
+			}
+		} else if settings.ServiceAccount != "" {
+			token, err = GenerateServiceAccountAccessTokenWithOptions(token.AccessToken, settings.ServiceAccount, settings.Scope,
+				ImpersonationOptions{Delegates: settings.Delegates, Lifetime: settings.ServiceAccountLifetime})
+			if err != nil {
+				return nil, err
 			}
 		}
 		if settings.Sts {
 			token, err = StsExchange(token.AccessToken, EncodeClaims(settings))
 			if err != nil {
-				fmt.Println(err)
-				return nil
+				return nil, err
 			}
 		}
 		err = InsertCache(settings, token)
 		if err != nil {
-			fmt.Println(err)
-			return nil
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// fetchDownscopedToken attempts to fetch and cache a token restricted by
+// the access boundary of the settings.
+//
+// The source token is fetched and cached by fetchToken under its own key,
+// so that it is refreshed and downscoped again once the downscoped token
+// expires, without authorizing again.
+func fetchDownscopedToken(settings *Settings, taskSettings *TaskSettings) (*oauth2.Token, error) {
+	usable := func(entry *CacheEntry) bool {
+		return !isCacheEntryStale(entry, taskSettings)
+	}
+	entry, err := lookupCacheEntry(settings, usable)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && usable(entry) {
+		return entry.Token, nil
+	}
+	sourceSettings := *settings // Make a shallow copy
+	sourceSettings.AccessBoundary = nil
+	source, err := fetchToken(&sourceSettings, taskSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockCacheKey(settings)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if cached, err := lookupCacheEntry(settings, usable); err == nil && cached != nil && usable(cached) {
+		return cached.Token, nil
+	}
+	token, err := DownscopeToken(source, settings.AccessBoundary, settings.StsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	err = InsertCache(settings, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Obtains a new token via the refresh token of the given stale cache entry.
+// Returns nil if the entry has no refresh token. If the refresh token has been
+// revoked or has expired, the entry is evicted and nil is returned.
+func refreshCachedToken(settings *Settings, entry *CacheEntry) (*oauth2.Token, error) {
+	if entry == nil || entry.Token.RefreshToken == "" || settings.GetAuthType() == AuthTypeExchange {
+		return nil, nil
+	}
+	if settings.Provider != nil {
+		// Generic providers have no credentials file to build a refresh
+		// token file from. The refresh grant is used directly instead.
+		config, _ := refreshClientConfig(settings)
+		token, err := RefreshTokenWithScope(context.Background(), config, entry.Token.RefreshToken)
+		if isInvalidGrant(err) {
+			return nil, evictCacheEntry(entry)
 		}
+		return token, err
+	}
+	// If creds cannot be retrieved here, which is unexpected, we will ignore
+	// the error and let FetchToken return a standardized error message
+	// in the subsequent step.
+	creds, _ := FindJSONCredentials(context.Background(), settings)
+	refreshTokenJSON := BuildRefreshTokenJSON(entry.Token.RefreshToken, creds)
+	if refreshTokenJSON == "" {
+		return nil, nil
+	}
+	refreshSettings := *settings // Make a shallow copy
+	refreshSettings.CredentialsJSON = refreshTokenJSON
+	if settings.GetAuthType() != AuthTypeIDToken {
+		refreshSettings.AuthType = AuthTypeOAuth
+	}
+	token, err := FetchToken(context.Background(), &refreshSettings)
+	if isInvalidGrant(err) {
+		return nil, evictCacheEntry(entry)
+	}
+	return token, err
+}
+
+// Mints an access token for the requested scopes from the refresh token of
+// a token cached for a superset of the scopes, so that the user does not
+// need to authorize again. Returns nil if there is no such token, or if its
+// refresh token has been revoked or has expired, in which case the cache
+// entry is evicted.
+func refreshSupersetToken(settings *Settings) (*oauth2.Token, error) {
+	digest := createKey(settings).Digest()
+	entry, err := lookupSupersetEntry(settings, func(entry *CacheEntry) bool {
+		return entry.Digest != digest && entry.Token.RefreshToken != ""
+	})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	// If the client cannot be read here, which is unexpected, we will ignore
+	// the error and let FetchToken return a standardized error message
+	// in the subsequent step.
+	config, err := refreshClientConfig(settings)
+	if err != nil {
+		return nil, nil
+	}
+	token, err := RefreshTokenWithScope(context.Background(), config, entry.Token.RefreshToken)
+	if isInvalidGrant(err) {
+		return nil, evictCacheEntry(entry)
+	}
+	return token, err
+}
+
+// Returns true if the token endpoint rejected the grant, such as a refresh
+// token that has been revoked or has expired.
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// Removes the given entry from the cache.
+func evictCacheEntry(entry *CacheEntry) error {
+	_, err := DeleteCacheEntries(func(e CacheEntry) bool {
+		return e.Digest == entry.Digest
+	})
+	return err
+}
+
+// Returns true if fetching a token with the given settings requires the user
+// to authorize access interactively, as in the 3LO and device flows.
+func requiresConsent(settings *Settings) bool {
+	authType := settings.GetAuthType()
+	if authType == AuthTypeProvider {
+		return settings.Provider.GetGrantType() == GrantTypeAuthorizationCode
+	}
+	// Keyless JWTs are signed by IAM on behalf of the base credentials.
+	keylessJWT := authType == AuthTypeJWT && settings.ServiceAccount != ""
+	if authType != AuthTypeOAuth && authType != AuthTypeDevice && authType != AuthTypeIDToken && !keylessJWT {
+		return false
 	}
-	return token
+	_, err := clientConfigFromJSON(settings.CredentialsJSON)
+	return err == nil
 }
 
 func isTokenExpired(token *oauth2.Token) bool {
+	return isTokenExpiring(token, 0)
+}
+
+// Returns true if the token expires within the given duration.
+func isTokenExpiring(token *oauth2.Token, within time.Duration) bool {
 	// SSO and STS tokens currently do not have expiration, as indicated by empty Expiry.
-	return token != nil && !token.Expiry.IsZero() && time.Now().After(token.Expiry)
+	return token != nil && !token.Expiry.IsZero() && time.Now().Add(within).After(token.Expiry)
 }
 
-func getCredentialType(creds *google.Credentials) string {
-	var m map[string]string
-	err := json.Unmarshal(creds.JSON, &m)
-	if err != nil && m["type"] != "" {
-		return m["type"]
+// Returns true if the cached token must be refreshed or fetched again,
+// because it expires within the minimum validity, or because it has no
+// expiry and has been cached for longer than the cache TTL.
+func isCacheEntryStale(entry *CacheEntry, taskSettings *TaskSettings) bool {
+	if entry.Token.Expiry.IsZero() {
+		return taskSettings.CacheTTL > 0 && time.Since(entry.CachedAt) > taskSettings.CacheTTL
 	}
-	return ""
+	return isTokenExpiring(entry.Token, taskSettings.MinValidity)
+}
+
+func getCredentialType(creds *google.Credentials) string {
+	return getCredentialsIdentity(string(creds.JSON)).Type
 }
 
 // Prints the token with the specified format.
@@ -240,14 +652,45 @@ func printToken(token *oauth2.Token, format string, settings *Settings) {
 		case formatJsonCompact:
 			printJson(token, "")
 		case formatPretty:
+			if settings.GetAuthType() == AuthTypeMetadata {
+				email, err := MetadataServiceAccountEmail(context.Background())
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+				fmt.Printf("Fetched credentials of type:\n  %s\n"+
+					"Service Account:\n  %s\n"+
+					"Access Token:\n  %s\n",
+					AuthTypeMetadata, email, token.AccessToken)
+				return
+			}
+			if settings.GetAuthType() == AuthTypeProvider {
+				fmt.Printf("Fetched credentials of type:\n  %s\n"+
+					"Client ID:\n  %s\n"+
+					"Access Token:\n  %s\n",
+					AuthTypeProvider, settings.Provider.ClientID, token.AccessToken)
+				return
+			}
 			creds, err := FindJSONCredentials(context.Background(), settings)
 			if err != nil {
 				log.Fatal(err.Error())
 			}
-			fmt.Printf("Fetched credentials of type:\n  %s\n"+
-				"Access Token:\n  %s\n",
-				getCredentialType(creds), token.AccessToken)
+			credsType := getCredentialType(creds)
+			fmt.Printf("Fetched credentials of type:\n  %s\n", credsType)
+			if credsType == externalAccountKey {
+				printExternalAccountInfo(getExternalAccountInfo(creds.JSON))
+			}
+			fmt.Printf("Access Token:\n  %s\n", token.AccessToken)
 		case formatRefreshToken:
+			if settings.GetAuthType() == AuthTypeMetadata {
+				log.Fatalf("Refresh token output format is not supported for the metadata server")
+			}
+			if settings.GetAuthType() == AuthTypeProvider {
+				if token.RefreshToken == "" {
+					log.Fatalf("No refresh token was issued by the provider")
+				}
+				fmt.Println(token.RefreshToken)
+				return
+			}
 			creds, err := FindJSONCredentials(context.Background(), settings)
 			if err != nil {
 				log.Fatal(err.Error())
@@ -257,7 +700,10 @@ func printToken(token *oauth2.Token, format string, settings *Settings) {
 				log.Fatalf("Refresh token output format is not supported for Service Account credentials type")
 			}
 			if credsType == externalAccountKey {
-				log.Fatalf("Refresh token output format is not supported for External Account credentials type")
+				// External accounts have no refresh token. The configuration
+				// itself is used to obtain new tokens.
+				fmt.Println(strings.TrimSpace(string(creds.JSON)))
+				return
 			}
 			if credsType == userCredentialsKey {
 				fmt.Print(string(creds.JSON)) // The input credential is already in refresh token format.
@@ -269,6 +715,20 @@ func printToken(token *oauth2.Token, format string, settings *Settings) {
 	}
 }
 
+// Prints the identity pool, provider and impersonated Service Account of
+// external_account credentials.
+func printExternalAccountInfo(info externalAccountInfo) {
+	if info.Pool != "" {
+		fmt.Printf("Identity Pool:\n  %s\nProvider:\n  %s\n", info.Pool, info.Provider)
+	}
+	if info.CredentialSource != "" {
+		fmt.Printf("Credential Source:\n  %s\n", info.CredentialSource)
+	}
+	if info.ServiceAccount != "" {
+		fmt.Printf("Impersonated Service Account:\n  %s\n", info.ServiceAccount)
+	}
+}
+
 func printHeader(tokenType string, token string) {
 	fmt.Println(BuildHeader(tokenType, token))
 }
@@ -281,3 +741,47 @@ func printJson(token *oauth2.Token, indent string) {
 	}
 	fmt.Println(string(data))
 }
+
+// Returns the abbreviated digest used as ID by the cache commands.
+func shortDigest(digest string) string {
+	id := strings.TrimPrefix(digest, cacheKeyDigestPrefix)
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Returns the scopes as a comma separated list, without the Google
+// OAuth scope prefix.
+func shortScopes(scope string) string {
+	scopes := strings.Fields(scope)
+	for i, s := range scopes {
+		scopes[i] = strings.TrimPrefix(s, googleScopePrefix)
+	}
+	return strings.Join(scopes, ",")
+}
+
+func formatExpiry(token *oauth2.Token) string {
+	if token.Expiry.IsZero() {
+		return "none"
+	} else if isTokenExpired(token) {
+		return token.Expiry.Format(time.RFC3339) + " (expired)"
+	}
+	return token.Expiry.Format(time.RFC3339)
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}